@@ -0,0 +1,191 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/fission/fission"
+)
+
+// defaultUserAgent is the User-Agent the API server sees unless
+// SetupOptions.UserAgent says otherwise.
+func defaultUserAgent() string {
+	version := fission.Version
+	if len(version) == 0 {
+		version = "unknown"
+	}
+	return "fission-portforward/" + version
+}
+
+// buildConfig returns the config for talking to the cluster. An
+// explicit API server URL takes precedence, then an explicit kubeconfig
+// path; without either we assume we're running in a pod and use the
+// in-cluster config. Like KUBECONFIG, opts.KubeConfig may list several
+// files to merge, separated by os.PathListSeparator.
+func buildConfig(opts SetupOptions) (*rest.Config, error) {
+	if len(opts.APIServerURL) > 0 {
+		opts.logger().Verbose(2, "Using API server %v", opts.APIServerURL)
+		return &rest.Config{
+			Host:        opts.APIServerURL,
+			BearerToken: opts.BearerToken,
+			TLSClientConfig: rest.TLSClientConfig{
+				Insecure: opts.InsecureSkipTLSVerify,
+			},
+		}, nil
+	}
+
+	kubeConfig := opts.KubeConfig
+	if len(kubeConfig) == 0 {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "No kubeconfig given and not running in a cluster")
+		}
+		opts.logger().Verbose(2, "Using in-cluster config, API server %v", config.Host)
+		return config, nil
+	}
+
+	rules := &clientcmd.ClientConfigLoadingRules{}
+	paths := filepath.SplitList(kubeConfig)
+	if len(paths) == 1 {
+		rules.ExplicitPath = paths[0]
+	} else {
+		rules.Precedence = paths
+	}
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: opts.Context,
+	}
+	overrides.Context.Cluster = opts.ClusterOverride
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error loading kubeconfig %v", kubeConfig))
+	}
+
+	context := opts.Context
+	if len(context) == 0 {
+		raw, err := clientConfig.RawConfig()
+		if err == nil {
+			context = raw.CurrentContext
+		}
+	}
+	opts.logger().Verbose(2, "Using kubeconfig %v, context %v, API server %v", kubeConfig, context, config.Host)
+	return config, nil
+}
+
+// cachedClient is a config and clientset built from a kubeconfig, along
+// with the modification times of its files when it was built.
+type cachedClient struct {
+	config    *rest.Config
+	clientset kubernetes.Interface
+	modTimes  []time.Time
+}
+
+var (
+	clientCacheLock sync.Mutex
+	clientCache     = make(map[string]*cachedClient)
+)
+
+// connect returns the config and a clientset for talking to the
+// cluster, with opts.APITimeout, the rate limits and the user agent set.
+// They're reused across calls with the same kubeconfig, context,
+// cluster, API server, timeout, rate limits and user agent, until one of
+// the kubeconfig files changes.
+func connect(opts SetupOptions) (*rest.Config, kubernetes.Interface, error) {
+	key := fmt.Sprintf("%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v", opts.KubeConfig, opts.Context, opts.ClusterOverride,
+		opts.APIServerURL, opts.BearerToken, opts.InsecureSkipTLSVerify, opts.APITimeout, opts.QPS, opts.Burst, opts.UserAgent)
+	modTimes := kubeConfigModTimes(opts.KubeConfig)
+
+	clientCacheLock.Lock()
+	defer clientCacheLock.Unlock()
+
+	cached, ok := clientCache[key]
+	if ok && sameTimes(cached.modTimes, modTimes) {
+		return cached.config, cached.clientset, nil
+	}
+
+	config, err := buildConfig(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Timeout = opts.APITimeout
+	if opts.QPS > 0 {
+		config.QPS = opts.QPS
+	}
+	if opts.Burst > 0 {
+		config.Burst = opts.Burst
+	}
+	config.UserAgent = opts.UserAgent
+	if len(config.UserAgent) == 0 {
+		config.UserAgent = defaultUserAgent()
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientCache[key] = &cachedClient{
+		config:    config,
+		clientset: clientset,
+		modTimes:  modTimes,
+	}
+	return config, clientset, nil
+}
+
+// InvalidateClientCache forgets the configs and clientsets built for
+// earlier port forwards, so the next one reloads its kubeconfig. That
+// happens anyway when a kubeconfig file changes; this is for changes
+// that don't show up in the files' modification times.
+func InvalidateClientCache() {
+	clientCacheLock.Lock()
+	defer clientCacheLock.Unlock()
+	clientCache = make(map[string]*cachedClient)
+}
+
+// kubeConfigModTimes returns the modification times of the files in
+// kubeConfig, or zero for ones that don't exist.
+func kubeConfigModTimes(kubeConfig string) []time.Time {
+	paths := filepath.SplitList(kubeConfig)
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testConfigHeader = `apiVersion: v1
+kind: Config
+`
+
+const testClusterConfig = `clusters:
+- name: test
+  cluster:
+    server: https://test.example.com:6443
+- name: other
+  cluster:
+    server: https://other.example.com:6443
+`
+
+const testContextConfig = `current-context: test
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+- name: staging
+  context:
+    cluster: test
+    user: staging
+users:
+- name: test
+  user:
+    token: secret
+- name: staging
+  user:
+    token: staging-secret
+`
+
+func TestBuildConfigMergesPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portforward")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusterPath := filepath.Join(dir, "cluster")
+	contextPath := filepath.Join(dir, "context")
+	if err := ioutil.WriteFile(clusterPath, []byte(testConfigHeader+testClusterConfig), 0600); err != nil {
+		t.Fatalf("Error writing kubeconfig: %v", err)
+	}
+	if err := ioutil.WriteFile(contextPath, []byte(testConfigHeader+testContextConfig), 0600); err != nil {
+		t.Fatalf("Error writing kubeconfig: %v", err)
+	}
+
+	config, err := buildConfig(SetupOptions{
+		KubeConfig: contextPath + string(os.PathListSeparator) + clusterPath,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Host != "https://test.example.com:6443" {
+		t.Errorf("Expected host from the cluster file, got %v", config.Host)
+	}
+	if config.BearerToken != "secret" {
+		t.Errorf("Expected token from the context file, got %v", config.BearerToken)
+	}
+
+	_, err = buildConfig(SetupOptions{KubeConfig: contextPath})
+	if err == nil {
+		t.Errorf("Expected an error for a kubeconfig without the cluster")
+	}
+}
+
+func TestBuildConfigOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portforward")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testConfigHeader+testClusterConfig+testContextConfig), 0600); err != nil {
+		t.Fatalf("Error writing kubeconfig: %v", err)
+	}
+
+	config, err := buildConfig(SetupOptions{
+		KubeConfig:      path,
+		Context:         "staging",
+		ClusterOverride: "other",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.BearerToken != "staging-secret" {
+		t.Errorf("Expected the staging context's token, got %v", config.BearerToken)
+	}
+	if config.Host != "https://other.example.com:6443" {
+		t.Errorf("Expected the overridden cluster's host, got %v", config.Host)
+	}
+}
+
+func TestBuildConfigAPIServerURL(t *testing.T) {
+	config, err := buildConfig(SetupOptions{
+		KubeConfig:            "/nonexistent",
+		APIServerURL:          "https://10.0.0.1:6443",
+		BearerToken:           "ci-token",
+		InsecureSkipTLSVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Host != "https://10.0.0.1:6443" || config.BearerToken != "ci-token" || !config.Insecure {
+		t.Errorf("Expected the given API server, token and TLS setting, got %v", config)
+	}
+}
+
+func TestConnectRateLimits(t *testing.T) {
+	defer InvalidateClientCache()
+
+	opts := SetupOptions{APIServerURL: "https://10.0.0.1:6443"}
+	config, _, err := connect(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.QPS != 0 || config.Burst != 0 {
+		t.Errorf("Expected client-go's default rate limits, got QPS %v, burst %v", config.QPS, config.Burst)
+	}
+
+	opts.QPS = 50
+	opts.Burst = 100
+	config, _, err = connect(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.QPS != 50 || config.Burst != 100 {
+		t.Errorf("Expected QPS 50, burst 100, got QPS %v, burst %v", config.QPS, config.Burst)
+	}
+}
+
+func TestConnectUserAgent(t *testing.T) {
+	defer InvalidateClientCache()
+
+	opts := SetupOptions{APIServerURL: "https://10.0.0.1:6443"}
+	config, _, err := connect(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(config.UserAgent, "fission-portforward/") {
+		t.Errorf("Expected the default user agent, got %q", config.UserAgent)
+	}
+
+	// the clientset sends it
+	userAgents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"kind":"PodList","apiVersion":"v1","items":[]}`)
+	}))
+	defer server.Close()
+
+	_, clientset, err := connect(SetupOptions{APIServerURL: server.URL, UserAgent: "release-bot/1.2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = clientset.CoreV1().Pods("fission").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Error listing pods: %v", err)
+	}
+	if userAgent := <-userAgents; userAgent != "release-bot/1.2" {
+		t.Errorf("Expected user agent release-bot/1.2, got %q", userAgent)
+	}
+}
+
+func TestConnectCachesClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portforward")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer InvalidateClientCache()
+
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testConfigHeader+testClusterConfig+testContextConfig), 0600); err != nil {
+		t.Fatalf("Error writing kubeconfig: %v", err)
+	}
+	opts := SetupOptions{KubeConfig: path}
+
+	_, first, err := connect(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, second, err := connect(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != second {
+		t.Errorf("Expected the clientset to be reused")
+	}
+
+	// a changed kubeconfig is reloaded
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("Error touching kubeconfig: %v", err)
+	}
+	_, third, err := connect(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if third == second {
+		t.Errorf("Expected a new clientset after the kubeconfig changed")
+	}
+
+	InvalidateClientCache()
+	_, fourth, err := connect(opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fourth == third {
+		t.Errorf("Expected a new clientset after invalidating the cache")
+	}
+}
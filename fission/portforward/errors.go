@@ -0,0 +1,134 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by the port forward setup functions, possibly wrapped
+// with more context; use errors.Cause to check for them.
+var (
+	// ErrNoPods means no pods match the label selector.
+	ErrNoPods = errors.New("No matching pods found")
+
+	// ErrNoReadyPods means there are matching pods, but none of them
+	// are ready.
+	ErrNoReadyPods = errors.New("No matching pods are ready")
+
+	// ErrServiceNotFound means no service matches the label selector.
+	ErrServiceNotFound = errors.New("Service not found")
+
+	// ErrUpgradeFailed means the connection to the pod couldn't be
+	// upgraded to SPDY, which port forwarding needs. That's often a
+	// proxy or load balancer in front of the API server that doesn't
+	// support it.
+	ErrUpgradeFailed = errors.New("Failed to upgrade the connection to SPDY")
+
+	// ErrForbidden means the user isn't allowed to port forward to the
+	// pod, which needs permission to create pods/portforward in its
+	// namespace.
+	ErrForbidden = errors.New("Not allowed to port forward")
+
+	// ErrRemotePortClosed means the forward connected to the pod, but
+	// nothing is listening on the port being forwarded to, with
+	// SetupOptions.CheckRemotePort.
+	ErrRemotePortClosed = errors.New("Nothing is listening on the remote port")
+
+	// ErrUnsupportedProtocol means the service port to forward to isn't
+	// TCP; Kubernetes only forwards TCP.
+	ErrUnsupportedProtocol = errors.New("Only TCP ports can be forwarded")
+
+	// ErrPortNotFound means there's no port to forward to: the service
+	// has no such port, or the pod doesn't declare the port the service
+	// targets.
+	ErrPortNotFound = errors.New("Port not found")
+)
+
+// MultipleInstallsError is returned when the label selector matches
+// pods in more than one namespace. That's usually more than one fission
+// install on the cluster, but may just be a selector that's too broad;
+// either way we can't tell which pod to use. Pods lists the candidates,
+// e.g. for asking the user to pick one.
+type MultipleInstallsError struct {
+	LabelSelector string
+	Namespaces    []string
+	Pods          []PodRef
+}
+
+func (err *MultipleInstallsError) Error() string {
+	pods := make([]string, 0, len(err.Pods))
+	for _, pod := range err.Pods {
+		pods = append(pods, pod.String())
+	}
+	return fmt.Sprintf("Found pods matching %v in %v namespaces (%v); "+
+		"set FISSION_NAMESPACE to one of: %v, or use a more specific selector",
+		err.LabelSelector, len(err.Namespaces), strings.Join(pods, " "), strings.Join(err.Namespaces, " "))
+}
+
+// MultipleServicesError is returned when more than one service matches
+// the label selector, so it's not clear which one's ports to use. Set
+// SetupOptions.ServiceName to pick one.
+type MultipleServicesError struct {
+	LabelSelector string
+	Namespace     string
+	Names         []string
+}
+
+func (err *MultipleServicesError) Error() string {
+	return fmt.Sprintf("Found %v services matching %v in %v (%v); set a service name to pick one",
+		len(err.Names), err.LabelSelector, err.Namespace, strings.Join(err.Names, " "))
+}
+
+// SelectorsError is returned when none of several label selectors
+// resolves to a pod to forward to. Errors holds what went wrong for
+// each of Selectors.
+type SelectorsError struct {
+	Selectors []string
+	Errors    []error
+}
+
+func (err *SelectorsError) Error() string {
+	msgs := make([]string, 0, len(err.Selectors))
+	for i, selector := range err.Selectors {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", selector, err.Errors[i]))
+	}
+	return fmt.Sprintf("None of %v label selectors matched a pod to forward to (%v)",
+		len(err.Selectors), strings.Join(msgs, "; "))
+}
+
+// ForwardError is returned when a running port forward fails.
+// StreamErrors holds the most recent errors copying data through the
+// forward, which often explain what went wrong.
+type ForwardError struct {
+	Err          error
+	StreamErrors []error
+}
+
+func (err *ForwardError) Error() string {
+	if len(err.StreamErrors) == 0 {
+		return err.Err.Error()
+	}
+	msgs := make([]string, 0, len(err.StreamErrors))
+	for _, streamErr := range err.StreamErrors {
+		msgs = append(msgs, streamErr.Error())
+	}
+	return fmt.Sprintf("%v (recent stream errors: %v)", err.Err, strings.Join(msgs, "; "))
+}
@@ -0,0 +1,412 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Forwarder is a handle to a running port forward started by Start.
+type Forwarder struct {
+	// LocalPort is the local port that's forwarded to the pod.
+	LocalPort int
+
+	bindAddress  string
+	stopChannel  chan struct{}
+	stopOnce     sync.Once
+	readyChannel chan struct{}
+	doneChannel  chan struct{}
+
+	// restartChannel takes requests to Restart, to be answered on the
+	// channel sent
+	restartChannel chan chan error
+
+	// err is why the forward ended, set before doneChannel is closed
+	err error
+
+	infoLock     sync.Mutex
+	info         ForwardInfo
+	listenerAddr net.Addr
+	status       ForwardStatus
+
+	// extraPorts are the forwarded SetupOptions.ExtraRemotePorts
+	extraPorts []ForwardedPort
+
+	// bytes counts the data through the forward, with
+	// SetupOptions.CountBytes
+	bytes *byteCounts
+
+	// conns counts the connections being forwarded, for StopGraceful
+	conns *connCount
+
+	listenersLock sync.Mutex
+	listeners     []net.Listener
+}
+
+// ForwardState is what a port forward is up to, as reported by Status.
+type ForwardState string
+
+const (
+	// StateConnecting means the forward is being set up.
+	StateConnecting ForwardState = "connecting"
+
+	// StateHealthy means the forward accepts connections and is
+	// connected to a pod.
+	StateHealthy ForwardState = "healthy"
+
+	// StateReconnecting means the connection to the pod was lost and
+	// the forward is trying to reconnect, with SetupOptions.Reconnect.
+	StateReconnecting ForwardState = "reconnecting"
+
+	// StateStopped means the forward has ended.
+	StateStopped ForwardState = "stopped"
+)
+
+// ForwardStatus is a port forward's state, and the last error if it's
+// reconnecting or has failed.
+type ForwardStatus struct {
+	State ForwardState
+	Err   error
+}
+
+// ForwardInfo describes what a port forward is connected to.
+type ForwardInfo struct {
+	// LocalPort is the local port that's forwarded to the pod.
+	LocalPort int
+
+	// PodName and PodNamespace identify the pod being forwarded to.
+	PodName      string
+	PodNamespace string
+
+	// TargetPort is the port on the pod being forwarded to.
+	TargetPort int
+
+	// Service is the service TargetPort was found from, e.g. to read
+	// its annotations, or nil if SetupOptions.RemotePort was used.
+	// It's shared, so it mustn't be modified.
+	Service *apiv1.Service
+}
+
+func makeForwarder(bindAddress string, localPort int) *Forwarder {
+	return &Forwarder{
+		LocalPort:      localPort,
+		bindAddress:    bindAddress,
+		stopChannel:    make(chan struct{}),
+		readyChannel:   make(chan struct{}),
+		doneChannel:    make(chan struct{}),
+		restartChannel: make(chan chan error),
+		info:           ForwardInfo{LocalPort: localPort},
+		status:         ForwardStatus{State: StateConnecting},
+		conns:          &connCount{},
+	}
+}
+
+// active is every forward that's running, for CloseAll.
+var (
+	activeLock sync.Mutex
+	active     = make(map[*Forwarder]struct{})
+)
+
+// track adds fw to the running forwards until it's done.
+func (fw *Forwarder) track() {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+	active[fw] = struct{}{}
+}
+
+// untrack removes fw from the running forwards.
+func (fw *Forwarder) untrack() {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+	delete(active, fw)
+}
+
+// CloseAll stops every running forward the package has started, by
+// whoever started it, and waits up to timeout for them to finish. It
+// fails if some of them haven't finished by then.
+func CloseAll(timeout time.Duration) error {
+	activeLock.Lock()
+	forwarders := make([]*Forwarder, 0, len(active))
+	for fw := range active {
+		forwarders = append(forwarders, fw)
+	}
+	activeLock.Unlock()
+
+	for _, fw := range forwarders {
+		fw.stop()
+	}
+
+	deadline := time.After(timeout)
+	for i, fw := range forwarders {
+		select {
+		case <-fw.doneChannel:
+		case <-deadline:
+			return errors.New(fmt.Sprintf("Timed out after %v waiting for %v port forwards to stop", timeout, len(forwarders)-i))
+		}
+	}
+	return nil
+}
+
+// ForwardedPort is a local port and the port on the pod it's forwarded
+// to, like client-go's portforward.ForwardedPort.
+type ForwardedPort struct {
+	Local  uint16
+	Remote uint16
+}
+
+// Ports returns the ports actually forwarded, with the local port as
+// bound by the listener, followed by SetupOptions.ExtraRemotePorts. It
+// fails if the forward isn't ready yet.
+func (fw *Forwarder) Ports() ([]ForwardedPort, error) {
+	if !fw.ready() {
+		return nil, errors.New(fmt.Sprintf("Port forward from local port %v isn't ready", fw.LocalPort))
+	}
+
+	ports := []ForwardedPort{{
+		Local:  uint16(fw.boundPort()),
+		Remote: uint16(fw.Info().TargetPort),
+	}}
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	return append(ports, fw.extraPorts...), nil
+}
+
+// UsePort returns the local port the forward is actually listening on,
+// which is the one to connect to. It fails if the forward isn't ready
+// yet.
+func (fw *Forwarder) UsePort() (int, error) {
+	if !fw.ready() {
+		return 0, errors.New(fmt.Sprintf("Port forward from local port %v isn't ready", fw.LocalPort))
+	}
+	return fw.boundPort(), nil
+}
+
+// boundPort returns the port the forward's listener is bound to, or
+// LocalPort if it isn't listening yet.
+func (fw *Forwarder) boundPort() int {
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	if addr, ok := fw.listenerAddr.(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return fw.LocalPort
+}
+
+// setListener records the listener the forward accepts connections on.
+func (fw *Forwarder) setListener(listener net.Listener) {
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	fw.listenerAddr = listener.Addr()
+}
+
+// setExtraPorts records the local ports SetupOptions.ExtraRemotePorts
+// are forwarded from.
+func (fw *Forwarder) setExtraPorts(ports []ForwardedPort) {
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	fw.extraPorts = ports
+}
+
+// BytesIn returns how many bytes have been copied from the pod to local
+// connections. It's always 0 unless SetupOptions.CountBytes is set.
+func (fw *Forwarder) BytesIn() int64 {
+	if fw.bytes == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&fw.bytes.in)
+}
+
+// BytesOut returns how many bytes have been copied from local
+// connections to the pod. It's always 0 unless SetupOptions.CountBytes
+// is set.
+func (fw *Forwarder) BytesOut() int64 {
+	if fw.bytes == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&fw.bytes.out)
+}
+
+// Info returns the pod the forward is connected to. With
+// SetupOptions.Reconnect, this can change after a reconnect.
+func (fw *Forwarder) Info() ForwardInfo {
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	return fw.info
+}
+
+// Status returns what the forward is up to, e.g. to show whether it's
+// usable while it reconnects.
+func (fw *Forwarder) Status() ForwardStatus {
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	return fw.status
+}
+
+// setStatus records the forward's state and why it's in it.
+func (fw *Forwarder) setStatus(state ForwardState, err error) {
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	fw.status = ForwardStatus{State: state, Err: err}
+}
+
+// setConnection records the pod a (re)connected forward is attached to.
+func (fw *Forwarder) setConnection(conn *podConnection) {
+	fw.infoLock.Lock()
+	defer fw.infoLock.Unlock()
+	fw.info.PodName = conn.podName
+	fw.info.PodNamespace = conn.podNamespace
+	fw.info.TargetPort = conn.remotePort
+	fw.info.Service = conn.service
+}
+
+// LocalAddr returns the local address the forward listens on: the
+// listener's own once it's listening.
+func (fw *Forwarder) LocalAddr() net.Addr {
+	fw.infoLock.Lock()
+	listenerAddr := fw.listenerAddr
+	fw.infoLock.Unlock()
+	if listenerAddr != nil {
+		return listenerAddr
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(fw.bindAddress, strconv.Itoa(fw.boundPort())))
+	if err != nil {
+		// bindAddress was good enough to listen on, so this won't
+		// happen, but don't return nil if it does
+		return &net.TCPAddr{Port: fw.LocalPort}
+	}
+	return addr
+}
+
+// LocalURL returns a URL for the local end of the forward with the
+// given scheme, e.g. "http://127.0.0.1:34567". For a forward listening
+// on all addresses, the URL is for loopback.
+func (fw *Forwarder) LocalURL(scheme string) string {
+	return scheme + "://" + fw.hostPort()
+}
+
+func (fw *Forwarder) hostPort() string {
+	return net.JoinHostPort(dialAddress(fw.bindAddress), strconv.Itoa(fw.boundPort()))
+}
+
+// DialContext connects to the local end of the forward, ignoring
+// network and addr, so that e.g. an http.Transport with fw.DialContext
+// as its DialContext sends every request through the forward.
+func (fw *Forwarder) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, listenNetwork(fw.bindAddress), fw.hostPort())
+}
+
+// ready says whether the forward has started accepting connections.
+func (fw *Forwarder) ready() bool {
+	select {
+	case <-fw.readyChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ready returns a channel that's closed once the forward first accepts
+// connections, e.g. for a select loop. Start only returns once that's
+// happened, and ReadyProbe passed, though the forward may have ended by
+// the time Ready is called; select on Done as well.
+func (fw *Forwarder) Ready() <-chan struct{} {
+	return fw.readyChannel
+}
+
+// Done returns a channel that's closed once the forward has ended.
+func (fw *Forwarder) Done() <-chan struct{} {
+	return fw.doneChannel
+}
+
+// Wait blocks until the forward ends and returns why: nil if it was
+// stopped, or the error it failed with.
+func (fw *Forwarder) Wait() error {
+	<-fw.doneChannel
+	return fw.err
+}
+
+// Restart picks the pod to forward to again and reconnects to it on
+// the same local port, e.g. after the pod was redeployed. Connections
+// already forwarded over the old connection carry on over it, for up to
+// 30s. If there's no pod to connect to, the forward carries on with the
+// old one and Restart returns why.
+func (fw *Forwarder) Restart() error {
+	reply := make(chan error, 1)
+	select {
+	case fw.restartChannel <- reply:
+	case <-fw.doneChannel:
+		return errors.New(fmt.Sprintf("Port forward from local port %v has ended", fw.LocalPort))
+	}
+	return <-reply
+}
+
+// StopGraceful stops the forward accepting connections, waits for the
+// ones in flight to finish, and then tears the forward down like Stop.
+// If ctx is done first, the remaining connections are cut off and
+// StopGraceful returns ctx's error.
+func (fw *Forwarder) StopGraceful(ctx context.Context) error {
+	fw.closeListeners()
+	var err error
+	select {
+	case <-fw.conns.idle():
+	case <-fw.doneChannel:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	fw.Stop()
+	return err
+}
+
+// addListener records a listener to close in StopGraceful.
+func (fw *Forwarder) addListener(listener net.Listener) {
+	fw.listenersLock.Lock()
+	defer fw.listenersLock.Unlock()
+	fw.listeners = append(fw.listeners, listener)
+}
+
+func (fw *Forwarder) closeListeners() {
+	fw.listenersLock.Lock()
+	defer fw.listenersLock.Unlock()
+	for _, listener := range fw.listeners {
+		listener.Close()
+	}
+}
+
+// Stop tears down the port forward and waits for it to finish. It's
+// safe to call Stop more than once.
+func (fw *Forwarder) Stop() {
+	fw.stop()
+	<-fw.doneChannel
+}
+
+// stop signals the port forward to shut down without waiting for it.
+func (fw *Forwarder) stop() {
+	fw.stopOnce.Do(func() {
+		close(fw.stopChannel)
+	})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+
+	"github.com/fission/fission/fission/log"
+)
+
+// Logger receives the diagnostics port forwards write. By default they
+// go to the fission/log package; set SetupOptions.Logger to send them
+// elsewhere.
+type Logger interface {
+	// Verbose logs a message that's only of interest at the given
+	// verbosity level or higher.
+	Verbose(level int, format string, args ...interface{})
+
+	// Warn logs a problem that doesn't stop the port forward, like a
+	// connection through it failing.
+	Warn(msg interface{})
+}
+
+// globalLogger is the Logger that writes to the fission/log package.
+type globalLogger struct{}
+
+func (globalLogger) Verbose(level int, format string, args ...interface{}) {
+	log.Verbose(level, format, args...)
+}
+
+func (globalLogger) Warn(msg interface{}) {
+	log.Warn(msg)
+}
+
+// logger returns opts.Logger, or the global logger if it's unset.
+func (opts SetupOptions) logger() Logger {
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	return globalLogger{}
+}
+
+// forwardLogger tags everything logged for one forward with its ID, so
+// that the logs of forwards running at the same time can be told apart.
+type forwardLogger struct {
+	id     string
+	logger Logger
+}
+
+func (l *forwardLogger) Verbose(level int, format string, args ...interface{}) {
+	l.logger.Verbose(level, "[fwd %v] "+format, append([]interface{}{l.id}, args...)...)
+}
+
+func (l *forwardLogger) Warn(msg interface{}) {
+	l.logger.Warn(fmt.Sprintf("[fwd %v] %v", l.id, msg))
+}
+
+// withForwardID returns a copy of opts whose logger tags messages with a
+// new forward ID, unless it already does.
+func (opts SetupOptions) withForwardID() SetupOptions {
+	if _, ok := opts.Logger.(*forwardLogger); !ok {
+		opts.Logger = &forwardLogger{
+			id:     fmt.Sprintf("%04x", randomIntn(1<<16)),
+			logger: opts.logger(),
+		}
+	}
+	return opts
+}
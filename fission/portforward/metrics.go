@@ -0,0 +1,73 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Count of port forwards started
+	forwardsStarted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "fission_portforward_started_total",
+			Help: "Count of port forwards started",
+		},
+	)
+	// Number of port forwards currently accepting connections
+	forwardsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "fission_portforward_active",
+			Help: "Number of port forwards currently accepting connections",
+		},
+	)
+	// Count of port forwards reconnected after losing their pod
+	forwardReconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "fission_portforward_reconnects_total",
+			Help: "Count of port forward reconnects",
+		},
+	)
+	// Time from starting a port forward until it accepts connections
+	forwardReadyDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "fission_portforward_ready_seconds",
+			Help:    "Time for a port forward to start accepting connections.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+)
+
+// RegisterMetrics registers the port forward metrics with r. The
+// metrics aren't registered by default, so that the CLI doesn't export
+// them; long-running programs can opt in with
+// RegisterMetrics(prometheus.DefaultRegisterer).
+func RegisterMetrics(r prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		forwardsStarted,
+		forwardsActive,
+		forwardReconnects,
+		forwardReadyDuration,
+	}
+	for _, c := range collectors {
+		err := r.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
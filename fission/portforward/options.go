@@ -0,0 +1,412 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+const (
+	// defaultBindAddress is the local address forwards listen on unless
+	// SetupOptions.BindAddress says otherwise.
+	defaultBindAddress = "127.0.0.1"
+
+	// defaultPollInterval is how often to try SetupOptions.ReadyProbe
+	// unless SetupOptions.PollInterval is set.
+	defaultPollInterval = 100 * time.Millisecond
+
+	// defaultAPIAttempts and defaultAPIRetryInterval control retries
+	// of failed API calls unless SetupOptions says otherwise.
+	defaultAPIAttempts      = 3
+	defaultAPIRetryInterval = 500 * time.Millisecond
+
+	// defaultServiceRetryInterval is how long to wait between looks for
+	// the service unless SetupOptions.ServiceRetryInterval is set.
+	defaultServiceRetryInterval = time.Second
+
+	// containerPollInterval is how often to check whether the target
+	// container is ready, with SetupOptions.WaitForContainer.
+	containerPollInterval = time.Second
+)
+
+// SetupOptions describes the port forward to set up with Start.
+type SetupOptions struct {
+	// KubeConfig is the path to the kubeconfig file, or several
+	// separated by os.PathListSeparator. If empty, the in-cluster
+	// config is used. Ignored if APIServerURL is set.
+	KubeConfig string
+
+	// Context is the kubeconfig context to use instead of its current
+	// context. Ignored when using the in-cluster config.
+	Context string
+
+	// ClusterOverride is the kubeconfig cluster to use instead of the
+	// one the context names. Ignored when using the in-cluster config.
+	ClusterOverride string
+
+	// APIServerURL, if set, is the API server to talk to, with
+	// BearerToken, instead of reading a kubeconfig, e.g. in a CI
+	// sandbox that has a token but no kubeconfig.
+	APIServerURL string
+
+	// BearerToken authenticates to APIServerURL.
+	BearerToken string
+
+	// InsecureSkipTLSVerify skips verifying APIServerURL's certificate.
+	InsecureSkipTLSVerify bool
+
+	// Namespace to look for the pod in; all namespaces if empty.
+	Namespace string
+
+	// LabelSelector selects the pod and service to forward to. If it's
+	// empty and PodName is set, the pod is looked up by name instead.
+	LabelSelector string
+
+	// LabelSelectors are more selectors to try, in order, if
+	// LabelSelector doesn't match a pod, e.g. for labels that changed
+	// between fission versions. The first one to match is used, for
+	// both the pod and the service.
+	LabelSelectors []string
+
+	// WorkloadKind and WorkloadName, if set, forward to a pod of the
+	// Deployment or StatefulSet called WorkloadName, like kubectl
+	// port-forward deployment/name, by using its selector in place of
+	// LabelSelector. Namespace defaults to "default" then.
+	WorkloadKind string
+	WorkloadName string
+
+	// FieldSelector, if set, further narrows down the pods matching
+	// LabelSelector, e.g. "spec.nodeName=node-1". It isn't applied to
+	// the service lookup, since services don't have most pod fields.
+	FieldSelector string
+
+	// PodListLimit, if set, caps how many pods matching the selectors
+	// are listed, to keep the lookup cheap on clusters with many pods
+	// sharing labels. Pods that aren't running are skipped server-side,
+	// and only the listed pods are considered when picking one, so with
+	// several matches which one is picked may change.
+	PodListLimit int64
+
+	// LocalPort is the local port to forward from. If zero, a free
+	// port is picked, from PortRange if it's set.
+	LocalPort int
+
+	// PortRange, if set, is the range of local ports to pick a free one
+	// from, lowest first, e.g. where policy only allows some ports.
+	PortRange PortRange
+
+	// PodName picks the pod with this name out of the ready pods
+	// matching the selectors. If empty, Strategy picks one.
+	PodName string
+
+	// Strategy picks one of the ready pods matching the selectors when
+	// PodName doesn't. Defaults to PickNewest.
+	Strategy PodSelectStrategy
+
+	// SelectPod, if set, is called to pick a pod when the selectors
+	// match pods in more than one namespace, instead of failing with a
+	// MultipleInstallsError. It must return one of candidates. With
+	// Reconnect, it may be called again on each reconnect.
+	SelectPod func(candidates []PodRef) (PodRef, error)
+
+	// AllowMultiple makes Strategy pick a pod even when the selectors
+	// match pods in more than one namespace, e.g. for automation on a
+	// cluster with several installs that uses precise selectors,
+	// instead of failing with a MultipleInstallsError. SelectPod, if
+	// set, still takes precedence.
+	AllowMultiple bool
+
+	// RemotePort, if set, is the port to forward to on the pod,
+	// skipping the service lookup, e.g. for a debug port no service
+	// exposes. It's required for a pod picked by PodName alone, since
+	// there's no service to find the port from.
+	RemotePort int
+
+	// ExtraRemotePorts are more ports on the same pod to forward, each
+	// from a free local port, e.g. a pprof port alongside the API. They
+	// share the forward's connection to the pod, so they live and die
+	// with it. Forwarder.Ports says which local port goes where.
+	ExtraRemotePorts []int
+
+	// ServiceName, if set, picks the service with this name when more
+	// than one matches the selector. Otherwise that's an error.
+	ServiceName string
+
+	// UseEndpoints picks the pod from the service's Endpoints instead of
+	// from the pods matching the selectors: the first ready address
+	// backing the service port, the way traffic to the service would
+	// go. With Reconnect, the Endpoints are read again on each
+	// reconnect, so the forward follows the service to another pod.
+	// RemotePort and Strategy don't apply.
+	UseEndpoints bool
+
+	// PortName is the name or number of the service port to forward
+	// to. If empty, the first port declared on the service is used.
+	PortName string
+
+	// APITimeout, if set, bounds each call to the API server, though
+	// not the connection to the pod once it's up. Start then also
+	// checks up front that the API server answers in time, so an
+	// unreachable cluster fails fast.
+	APITimeout time.Duration
+
+	// QPS and Burst, if set, override client-go's rate limit on calls
+	// to the API server, for tooling that makes many calls in a burst
+	// and would otherwise be throttled.
+	QPS   float32
+	Burst int
+
+	// UserAgent is sent to the API server, so its audit log shows which
+	// tool opened the forward. Defaults to "fission-portforward/" and
+	// the fission version.
+	UserAgent string
+
+	// APIAttempts is how many times to try calls to the API server
+	// that fail with errors that may go away, like network errors,
+	// server errors and throttling, waiting APIRetryInterval and then
+	// twice as long each time in between. Defaults to 3.
+	APIAttempts int
+
+	// APIRetryInterval is how long to wait before the first retry of a
+	// failed API call. Defaults to 500ms.
+	APIRetryInterval time.Duration
+
+	// ServiceAttempts is how many times to look for the service before
+	// giving up, waiting ServiceRetryInterval in between. This covers
+	// the window during an install where the pod is up before its
+	// service. Defaults to 1, i.e. no retries.
+	ServiceAttempts int
+
+	// ServiceRetryInterval is how long to wait between attempts to find
+	// the service. Defaults to 1s.
+	ServiceRetryInterval time.Duration
+
+	// BindAddress is the local address to listen on, IPv4 or IPv6,
+	// e.g. "::1". Defaults to 127.0.0.1.
+	BindAddress string
+
+	// Reconnect makes the forward pick a pod again and reconnect, on
+	// the same local port, when the connection to the pod is lost.
+	Reconnect bool
+
+	// Container, if set, is the container on the pod whose port to
+	// forward to: named target ports are looked up in it, it must
+	// declare the port, and it's the one WaitForContainer waits for.
+	// Containers share the pod's network, so this doesn't change what
+	// the forward connects to, only which declaration is used.
+	Container string
+
+	// WaitForPod, if set, is how long to wait for a matching pod to be
+	// ready if none is, e.g. while it's still pulling its image, rather
+	// than failing right away. The wait ends as soon as one is ready.
+	WaitForPod time.Duration
+
+	// WaitForContainer makes the forward wait for the container that
+	// serves the target port to be ready before connecting, rather
+	// than just the pod. If no container declares the port, all of them
+	// must be ready.
+	WaitForContainer bool
+
+	// RequireReadyNode makes connecting fail if the pod's node isn't
+	// ready. Otherwise that's only warned about.
+	RequireReadyNode bool
+
+	// CheckRemotePort makes the forward check, once connected, that
+	// something is listening on the port on the pod, failing with
+	// ErrRemotePortClosed if not. Without it, the forward comes up but
+	// every connection through it is dropped.
+	CheckRemotePort bool
+
+	// Keepalive, if set, is how often to forward an empty connection
+	// to the pod to keep the connection from being reaped as idle. If
+	// the probe fails, the forward reconnects like Restart, whether or
+	// not Reconnect is set; if that fails too, the connection is
+	// treated as lost.
+	Keepalive time.Duration
+
+	// MaxLifetime, if set, is how long a connection to the pod is used
+	// before the forward restarts, picking the pod again and keeping
+	// the local port, e.g. to beat a load balancer that cuts
+	// connections at a given age. Set it a bit under that limit. New
+	// connections go to the new connection straight away, while ones
+	// in flight finish over the old one. If the restart fails, the old
+	// connection is kept and it's tried again.
+	MaxLifetime time.Duration
+
+	// ReadyTimeout bounds how long to wait for the forward to start
+	// accepting connections. Zero means wait indefinitely.
+	ReadyTimeout time.Duration
+
+	// ReadyProbe, if set, must succeed before the forward counts as
+	// ready, e.g. an HTTP GET of a health check through localPort.
+	// It's tried once the forward accepts connections, and then again
+	// after PollInterval, backing off with jitter, until it succeeds.
+	// Without one, accepting connections is enough.
+	ReadyProbe func(localPort int) error
+
+	// ReadyAttempts is how many of the pods matching the selectors to
+	// try, each for up to ReadyTimeout, before giving up, in case the
+	// first one picked is wedged. Defaults to 1.
+	ReadyAttempts int
+
+	// skipPods are pods that already timed out getting ready, so aren't
+	// picked again.
+	skipPods []PodRef
+
+	// upgrade, if set, opens the connection to the pod in place of its
+	// portforward subresource; it's only set in tests.
+	upgrade func(podNamespace, podName string) (httpstream.Connection, error)
+
+	// PollInterval is how long to wait before trying ReadyProbe again.
+	// Further waits double, up to 1s, and are jittered so that many
+	// forwards starting at once don't probe in lockstep. Defaults to
+	// 100ms.
+	PollInterval time.Duration
+
+	// DryRun only resolves the pod and ports to forward, without
+	// forwarding anything. Start then returns a Forwarder that's
+	// already stopped, whose Info says what would have been forwarded.
+	DryRun bool
+
+	// MakeHTTPClient, if set, makes the http.Client used to upgrade the
+	// connection to the pod, e.g. to add timeouts or instrumentation.
+	// The client must send requests through transport, which does the
+	// SPDY upgrade; wrapping it is fine.
+	MakeHTTPClient func(transport http.RoundTripper) *http.Client
+
+	// DialTimeout, if set, bounds connecting to the pod through the API
+	// server, including the SPDY handshake, so that e.g. a load
+	// balancer that accepts the connection but never answers fails
+	// fast. Timing out isn't retried.
+	DialTimeout time.Duration
+
+	// UpgradeHeaders are extra headers to send with the request to
+	// connect to the pod, e.g. for a gateway in front of the API server
+	// that wants its own credentials on top of Kubernetes auth.
+	UpgradeHeaders map[string]string
+
+	// CountBytes makes the forward count the bytes copied through it,
+	// for Forwarder.BytesIn and BytesOut. It's off by default since it
+	// adds a little work to every copy.
+	CountBytes bool
+
+	// Logger, if set, gets the port forward's diagnostics instead of
+	// the fission/log package. Either way, they're tagged with an ID
+	// per forward, e.g. "[fwd a1b2]".
+	Logger Logger
+
+	// OutStream, if set, gets a line for each connection through the
+	// forward, regardless of verbosity. Otherwise they're logged at
+	// verbosity 2.
+	OutStream io.Writer
+
+	// ErrStream, if set, gets errors forwarding connections. Otherwise
+	// they're logged as warnings.
+	ErrStream io.Writer
+
+	// OnReady, if set, is called with the local port once the forward
+	// accepts connections.
+	OnReady func(localPort int)
+
+	// OnStage, if set, is called with each Stage the setup goes
+	// through, e.g. to show progress. Stages are reported again when
+	// reconnecting.
+	OnStage func(stage string)
+
+	// OnDisconnect, if set, is called when a forward that was ready
+	// ends: with nil after Stop, or with the error if it failed. It's
+	// called before Stop returns, so it mustn't call Stop itself.
+	OnDisconnect func(err error)
+}
+
+// PortRange is a range of local ports, Low to High inclusive.
+type PortRange struct {
+	Low  int
+	High int
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%v-%v", r.Low, r.High)
+}
+
+// PodSelectStrategy says which of several matching pods to forward to.
+type PodSelectStrategy string
+
+const (
+	// PickNewest picks the most recently created pod, e.g. the latest
+	// deploy. Pods created at the same time are ordered by name.
+	PickNewest PodSelectStrategy = "newest"
+
+	// PickOldest picks the least recently created pod, e.g. the one
+	// that's been stable longest. Ties are broken by name.
+	PickOldest PodSelectStrategy = "oldest"
+
+	// PickFirst picks the first pod the API server lists.
+	PickFirst PodSelectStrategy = "first"
+
+	// PickRandom picks a pod at random, e.g. to spread load across
+	// pods.
+	PickRandom PodSelectStrategy = "random"
+)
+
+// Stages of setting up a port forward, as reported to
+// SetupOptions.OnStage.
+const (
+	StageResolvingPod    = "resolving pod"
+	StageConnecting      = "connecting to pod"
+	StageStartingForward = "starting forward"
+	StageWaitingForReady = "waiting for ready"
+	StageReady           = "ready"
+)
+
+// stage reports the given stage to opts.OnStage, if set.
+func (opts SetupOptions) stage(stage string) {
+	if opts.OnStage != nil {
+		opts.OnStage(stage)
+	}
+}
+
+// withDefaults returns a copy of opts with unset fields defaulted.
+func (opts SetupOptions) withDefaults() SetupOptions {
+	if len(opts.BindAddress) == 0 {
+		opts.BindAddress = defaultBindAddress
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if opts.APIAttempts <= 0 {
+		opts.APIAttempts = defaultAPIAttempts
+	}
+	if opts.APIRetryInterval == 0 {
+		opts.APIRetryInterval = defaultAPIRetryInterval
+	}
+	if opts.ReadyAttempts <= 0 {
+		opts.ReadyAttempts = 1
+	}
+	if opts.ServiceAttempts <= 0 {
+		opts.ServiceAttempts = 1
+	}
+	if opts.ServiceRetryInterval == 0 {
+		opts.ServiceRetryInterval = defaultServiceRetryInterval
+	}
+	return opts
+}
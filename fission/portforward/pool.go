@@ -0,0 +1,151 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool shares port forwards between the users of the same target, so a
+// program that needs the same forward in several places sets it up once.
+// Forwards are stopped when their last user releases them.
+type Pool struct {
+	opts SetupOptions
+
+	// start starts a new forward; it's Start outside of tests
+	start func(ctx context.Context, opts SetupOptions) (*Forwarder, error)
+
+	lock        sync.Mutex
+	byTarget    map[poolKey]*poolEntry
+	byForwarder map[*Forwarder]*poolEntry
+}
+
+type poolKey struct {
+	namespace     string
+	labelSelector string
+}
+
+type poolEntry struct {
+	key  poolKey
+	refs int
+
+	// started is closed once the forward has started, or failed to
+	// with err; fw and err aren't set before then
+	started chan struct{}
+	fw      *Forwarder
+	err     error
+}
+
+// MakePool returns a Pool that starts forwards with opts, apart from
+// the namespace and label selector given to Get.
+func MakePool(opts SetupOptions) *Pool {
+	return &Pool{
+		opts:        opts,
+		start:       Start,
+		byTarget:    make(map[poolKey]*poolEntry),
+		byForwarder: make(map[*Forwarder]*poolEntry),
+	}
+}
+
+// Get returns a running forward to the pod matching labelSelector in
+// namespace, starting one if there isn't one already. Each Get must be
+// matched by a Release once the forward is no longer needed.
+func (p *Pool) Get(namespace, labelSelector string) (*Forwarder, error) {
+	key := poolKey{namespace: namespace, labelSelector: labelSelector}
+
+	p.lock.Lock()
+	entry, ok := p.byTarget[key]
+	if ok {
+		select {
+		case <-entry.started:
+			if !entry.ended() {
+				entry.refs++
+				p.lock.Unlock()
+				return entry.fw, nil
+			}
+		default:
+			// another Get is starting the forward; share it
+			entry.refs++
+			p.lock.Unlock()
+			<-entry.started
+			if entry.err != nil {
+				return nil, entry.err
+			}
+			return entry.fw, nil
+		}
+	}
+
+	// Starting can take a while, so don't hold up Gets for other
+	// targets and Releases meanwhile.
+	entry = &poolEntry{key: key, refs: 1, started: make(chan struct{})}
+	p.byTarget[key] = entry
+	p.lock.Unlock()
+
+	opts := p.opts
+	opts.Namespace = namespace
+	opts.LabelSelector = labelSelector
+	fw, err := p.start(context.Background(), opts)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil {
+		entry.err = err
+		if p.byTarget[key] == entry {
+			delete(p.byTarget, key)
+		}
+	} else {
+		entry.fw = fw
+		p.byForwarder[fw] = entry
+	}
+	close(entry.started)
+	return fw, err
+}
+
+// Release gives up a forward returned by Get, stopping it if this was
+// its last user.
+func (p *Pool) Release(fw *Forwarder) {
+	p.lock.Lock()
+	entry, ok := p.byForwarder[fw]
+	if !ok {
+		p.lock.Unlock()
+		return
+	}
+	entry.refs--
+	if entry.refs > 0 {
+		p.lock.Unlock()
+		return
+	}
+	delete(p.byForwarder, fw)
+	if p.byTarget[entry.key] == entry {
+		delete(p.byTarget, entry.key)
+	}
+	p.lock.Unlock()
+
+	fw.Stop()
+}
+
+// ended says whether the entry's forward has stopped or failed, in
+// which case Get starts a new one.
+func (entry *poolEntry) ended() bool {
+	select {
+	case <-entry.fw.Done():
+		return true
+	default:
+		return false
+	}
+}
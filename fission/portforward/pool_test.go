@@ -0,0 +1,181 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// startTestForward pretends to start a forward, which runs until it's
+// stopped.
+func startTestForward(ctx context.Context, opts SetupOptions) (*Forwarder, error) {
+	fw := makeForwarder(defaultBindAddress, 0)
+	go func() {
+		<-fw.stopChannel
+		close(fw.doneChannel)
+	}()
+	return fw, nil
+}
+
+func stopped(fw *Forwarder) bool {
+	select {
+	case <-fw.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPool(t *testing.T) {
+	pool := MakePool(SetupOptions{})
+	starts := 0
+	pool.start = func(ctx context.Context, opts SetupOptions) (*Forwarder, error) {
+		starts++
+		return startTestForward(ctx, opts)
+	}
+
+	first, err := pool.Get("fission", testSelector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := pool.Get("fission", testSelector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first != second || starts != 1 {
+		t.Errorf("Expected the forward to be shared, got %v starts", starts)
+	}
+
+	other, err := pool.Get("fission-other", testSelector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if other == first {
+		t.Errorf("Expected a separate forward for another namespace")
+	}
+
+	// the forward keeps running until its last user releases it
+	pool.Release(first)
+	if stopped(first) {
+		t.Errorf("Expected the forward to run while it's still used")
+	}
+	pool.Release(second)
+	if !stopped(first) {
+		t.Errorf("Expected the forward to stop once released")
+	}
+
+	// a stopped forward is replaced
+	third, err := pool.Get("fission", testSelector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if third == first || starts != 3 {
+		t.Errorf("Expected a new forward after the old one stopped, got %v starts", starts)
+	}
+	pool.Release(third)
+	pool.Release(other)
+}
+
+func TestPoolSlowStart(t *testing.T) {
+	pool := MakePool(SetupOptions{})
+	unblock := make(chan struct{})
+	var startsLock sync.Mutex
+	starts := make(map[string]int)
+	pool.start = func(ctx context.Context, opts SetupOptions) (*Forwarder, error) {
+		startsLock.Lock()
+		starts[opts.Namespace]++
+		startsLock.Unlock()
+		if opts.Namespace == "slow" {
+			<-unblock
+		}
+		return startTestForward(ctx, opts)
+	}
+
+	results := make(chan *Forwarder, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			fw, err := pool.Get("slow", testSelector)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			results <- fw
+		}()
+	}
+
+	// a forward that takes a while to start doesn't hold up others
+	done := make(chan error, 1)
+	go func() {
+		fw, err := pool.Get("fission", testSelector)
+		if err == nil {
+			pool.Release(fw)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Get for another target waited for the slow start")
+	}
+
+	close(unblock)
+	first, second := <-results, <-results
+	if first != second {
+		t.Errorf("Expected concurrent Gets to share the forward")
+	}
+	startsLock.Lock()
+	if starts["slow"] != 1 {
+		t.Errorf("Expected the slow forward to be started once, got %v", starts["slow"])
+	}
+	startsLock.Unlock()
+	pool.Release(first)
+	pool.Release(second)
+	if !stopped(first) {
+		t.Errorf("Expected the forward to stop once released")
+	}
+}
+
+func TestPoolStartError(t *testing.T) {
+	pool := MakePool(SetupOptions{})
+	fail := true
+	pool.start = func(ctx context.Context, opts SetupOptions) (*Forwarder, error) {
+		if fail {
+			return nil, errors.New("no pods")
+		}
+		return startTestForward(ctx, opts)
+	}
+
+	_, err := pool.Get("fission", testSelector)
+	if err == nil {
+		t.Fatalf("Expected the start error")
+	}
+
+	// a failed start isn't remembered
+	fail = false
+	fw, err := pool.Get("fission", testSelector)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pool.Release(fw)
+}
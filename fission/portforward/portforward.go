@@ -17,176 +17,1146 @@ limitations under the License.
 package portforward
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"runtime/debug"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	// register the auth provider plugins, e.g. for GKE, which the
+	// connection to the pod needs as much as the clientset does
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
 
 	"github.com/fission/fission/fission/log"
 )
 
+const (
+	// maxBindAttempts is how many free ports we try before giving up
+	maxBindAttempts = 5
+
+	// bindRetryInterval is the initial wait between bind attempts; it
+	// doubles after every attempt.
+	bindRetryInterval = 50 * time.Millisecond
+
+	// reconnectInterval is the initial wait before reconnecting a
+	// dropped forward; it doubles on every failed attempt, up to
+	// maxReconnectInterval.
+	reconnectInterval    = 500 * time.Millisecond
+	maxReconnectInterval = 30 * time.Second
+
+	// restartDrainTimeout is how long the old connection to the pod is
+	// kept after a restart, for the connections still using it.
+	restartDrainTimeout = 30 * time.Second
+)
+
 // Port forward a free local port to a pod on the cluster. The pod is
 // found in the specified namespace by labelSelector. The pod's port
 // is found by looking for a service in the same namespace and using
 // its targetPort. Once the port forward is started, wait for it to
 // start accepting connections before returning.
+//
+// Setup calls FatalHandler, which exits the process by default, on any
+// error; use SetupE to handle errors yourself.
 func Setup(kubeConfig, namespace, labelSelector string) string {
-	log.Verbose(2, "Setting up port forward to %s in namespace %s using the kubeconfig at %s",
-		labelSelector, namespace, kubeConfig)
+	localPort, err := SetupE(kubeConfig, namespace, labelSelector)
+	if err != nil {
+		FatalHandler(err.Error())
+	}
+	return localPort
+}
 
-	localPort, err := findFreePort()
+// FatalHandler is called with the error message when Setup fails. It
+// exits the process by default; programs embedding this package can
+// replace it, e.g. to panic instead. If it returns, Setup returns an
+// empty port.
+var FatalHandler = func(msg string) {
+	log.Fatal(msg)
+}
+
+// SetupE is like Setup, but returns an error instead of exiting the
+// process when the port forward can't be established.
+func SetupE(kubeConfig, namespace, labelSelector string) (string, error) {
+	return SetupWithContext(context.Background(), kubeConfig, namespace, labelSelector)
+}
+
+// SetupWithContext is like SetupE, but gives up waiting for the port
+// forward when ctx is cancelled. The port forward itself is stopped
+// once ctx is done.
+func SetupWithContext(ctx context.Context, kubeConfig, namespace, labelSelector string) (string, error) {
+	fw, err := Start(ctx, SetupOptions{
+		KubeConfig:    kubeConfig,
+		Namespace:     namespace,
+		LabelSelector: labelSelector,
+	})
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error finding unused port :%v", err.Error()))
+		return "", err
 	}
+	return strconv.Itoa(fw.LocalPort), nil
+}
 
-	log.Verbose(2, "Waiting for local port %v", localPort)
-	for {
-		conn, _ := net.DialTimeout("tcp",
-			net.JoinHostPort("", localPort), time.Millisecond)
-		if conn != nil {
-			conn.Close()
-		} else {
-			break
+// SetupInt is like SetupE, but returns the local port as an int.
+func SetupInt(kubeConfig, namespace, labelSelector string) (int, error) {
+	fw, err := Start(context.Background(), SetupOptions{
+		KubeConfig:    kubeConfig,
+		Namespace:     namespace,
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fw.LocalPort, nil
+}
+
+// SetupInfo is like SetupE, but returns what the forward is connected
+// to, including the port on the pod, e.g. as found from a named service
+// port, along with the local port.
+func SetupInfo(kubeConfig, namespace, labelSelector string) (ForwardInfo, error) {
+	fw, err := Start(context.Background(), SetupOptions{
+		KubeConfig:    kubeConfig,
+		Namespace:     namespace,
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return ForwardInfo{}, err
+	}
+	return fw.Info(), nil
+}
+
+// SetupToPod port forwards a free local port to remotePort on the named
+// pod, skipping the label selector and service lookups, and returns the
+// local port.
+func SetupToPod(kubeConfig, namespace, podName string, remotePort int) (int, error) {
+	fw, err := Start(context.Background(), SetupOptions{
+		KubeConfig: kubeConfig,
+		Namespace:  namespace,
+		PodName:    podName,
+		RemotePort: remotePort,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fw.LocalPort, nil
+}
+
+// SetupToPodPorts is like SetupToPod, but forwards several ports on the
+// pod at once, over one connection to it, and returns the local port
+// for each remote port.
+func SetupToPodPorts(kubeConfig, namespace, podName string, remotePorts ...int) (map[int]int, error) {
+	if len(remotePorts) == 0 {
+		return nil, errors.New(fmt.Sprintf("No ports given to forward to on pod %v", podName))
+	}
+	fw, err := Start(context.Background(), SetupOptions{
+		KubeConfig:       kubeConfig,
+		Namespace:        namespace,
+		PodName:          podName,
+		RemotePort:       remotePorts[0],
+		ExtraRemotePorts: remotePorts[1:],
+	})
+	if err != nil {
+		return nil, err
+	}
+	ports, err := fw.Ports()
+	if err != nil {
+		return nil, err
+	}
+	localPorts := make(map[int]int, len(ports))
+	for _, port := range ports {
+		localPorts[int(port.Remote)] = int(port.Local)
+	}
+	return localPorts, nil
+}
+
+// SetupToWorkload port forwards a free local port to port on a ready
+// pod of the Deployment or StatefulSet called name, like kubectl
+// port-forward deployment/name, and returns the local port.
+func SetupToWorkload(kubeConfig, namespace, kind, name string, port int) (int, error) {
+	fw, err := Start(context.Background(), SetupOptions{
+		KubeConfig:   kubeConfig,
+		Namespace:    namespace,
+		WorkloadKind: kind,
+		WorkloadName: name,
+		RemotePort:   port,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fw.LocalPort, nil
+}
+
+// Start sets up a port forward like SetupWithContext and returns a
+// Forwarder handle that can be used to stop it.
+func Start(ctx context.Context, opts SetupOptions) (*Forwarder, error) {
+	opts = opts.withForwardID()
+	opts.logger().Verbose(2, "Setting up port forward to %s in namespace %s using the kubeconfig at %s",
+		opts.LabelSelector, opts.Namespace, opts.KubeConfig)
+
+	config, clientset, err := connect(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to Kubernetes")
+	}
+
+	// Nothing's sent to the API server until the pods are listed, so
+	// with a timeout, check that the server's there quickly up front.
+	if opts.APITimeout > 0 {
+		_, err = clientset.Discovery().ServerVersion()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Cannot reach API server at %v", config.Host))
 		}
-		time.Sleep(time.Millisecond * 50)
 	}
 
-	log.Verbose(2, "Starting port forward from local port %v", localPort)
-	go func() {
-		err := runPortForward(kubeConfig, labelSelector, localPort, namespace)
+	opts.logger().Verbose(2, "Connected to Kubernetes API")
+
+	return StartWithClient(ctx, config, clientset, opts)
+}
+
+// ForwardOnce sets up a port forward like Start, calls fn with its
+// local port, and stops the forward once fn returns or panics. It
+// returns fn's error, or the error setting up the forward.
+func ForwardOnce(ctx context.Context, opts SetupOptions, fn func(localPort int) error) error {
+	fw, err := Start(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer fw.Stop()
+	return fn(fw.LocalPort)
+}
+
+// ForwardExec sets up a port forward like Start and runs cmd with
+// envVarName set to the local port in its environment, and its input
+// and output connected to ours. The forward is stopped once cmd exits.
+func ForwardExec(ctx context.Context, opts SetupOptions, envVarName string, cmd []string) error {
+	if len(cmd) == 0 {
+		return errors.New("No command to run")
+	}
+	return ForwardOnce(ctx, opts, func(localPort int) error {
+		return runWithPort(ctx, envVarName, cmd, localPort)
+	})
+}
+
+// runWithPort runs cmd with envVarName set to localPort.
+func runWithPort(ctx context.Context, envVarName string, cmd []string, localPort int) error {
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	c.Env = append(os.Environ(), fmt.Sprintf("%v=%v", envVarName, localPort))
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := c.Run()
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error running %v", cmd[0]))
+	}
+	return nil
+}
+
+// StartWithClient is like Start, but talks to the cluster with the
+// given clientset instead of building one from opts.KubeConfig. config
+// is needed to set up the connection to the pod, and should be the
+// config clientset was built from.
+func StartWithClient(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, opts SetupOptions) (*Forwarder, error) {
+	opts = opts.withDefaults().withForwardID()
+
+	if len(opts.WorkloadName) > 0 {
+		if len(opts.Namespace) == 0 {
+			opts.Namespace = meta_v1.NamespaceDefault
+		}
+		var err error
+		opts.LabelSelector, err = workloadSelector(clientset, opts, opts.Namespace, opts.WorkloadKind, opts.WorkloadName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DryRun {
+		return dryRun(clientset, opts)
+	}
+
+	if opts.LocalPort != 0 {
+		err := checkPortFree(opts.BindAddress, opts.LocalPort)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("Error forwarding to controller port: %s", err.Error()))
+			return nil, err
+		}
+		return startAnyPod(ctx, config, clientset, opts, opts.LocalPort, nil)
+	}
+
+	// The forward listens on the free port's listener as it is, so no
+	// other process can grab the port in between. The port is bound
+	// again if the forward is retried on another pod, though, which
+	// can fail with a bindError; pick a new port and try again then.
+	backoff := bindRetryInterval
+	for attempt := 1; ; attempt++ {
+		localPort, listener, err := listenFreePort(opts.BindAddress, opts.PortRange)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error finding unused port")
+		}
+
+		fw, err := startAnyPod(ctx, config, clientset, opts, localPort, listener)
+		if _, ok := errors.Cause(err).(*bindError); !ok || attempt == maxBindAttempts {
+			return fw, err
+		}
+
+		opts.logger().Verbose(2, "Local port %v was taken before the port forward could bind it, retrying", localPort)
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "Error finding unused port")
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// dryRun resolves the pod and port a forward would connect to, and the
+// local port it would use, without forwarding anything.
+func dryRun(clientset kubernetes.Interface, opts SetupOptions) (*Forwarder, error) {
+	opts.stage(StageResolvingPod)
+	t, err := resolveTarget(clientset, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	localPort := opts.LocalPort
+	if localPort != 0 {
+		err = checkPortFree(opts.BindAddress, localPort)
+	} else {
+		localPort, err = findFreePort(opts.BindAddress, opts.PortRange)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error finding unused port")
+	}
+
+	opts.logger().Verbose(2, "Would forward local port %v to port %v on pod %v/%v",
+		localPort, t.remotePort, t.pod.Namespace, t.pod.Name)
+
+	fw := makeForwarder(opts.BindAddress, localPort)
+	fw.setConnection(&podConnection{
+		podName:      t.pod.Name,
+		podNamespace: t.pod.Namespace,
+		remotePort:   t.remotePort,
+		service:      t.service,
+	})
+	fw.setStatus(StateStopped, nil)
+	close(fw.doneChannel)
+	return fw, nil
+}
+
+// ForwardTarget is one of the port forwards to set up with SetupMany.
+type ForwardTarget struct {
+	Namespace     string
+	LabelSelector string
+
+	// LocalPort is the local port to forward from, or zero to pick a
+	// free one.
+	LocalPort int
+}
+
+// SetupMany sets up port forwards to all targets at once, sharing one
+// connection to the cluster, and returns the local port for each
+// target's label selector, so the selectors must all differ. It only
+// returns once every forward accepts connections; if any of them fails,
+// the others are stopped. The forwards are stopped when ctx is done.
+func SetupMany(ctx context.Context, kubeConfig string, targets []ForwardTarget) (map[string]int, error) {
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if seen[target.LabelSelector] {
+			return nil, errors.New(fmt.Sprintf("More than one target with label selector %v", target.LabelSelector))
+		}
+		seen[target.LabelSelector] = true
+	}
+
+	config, clientset, err := connect(SetupOptions{KubeConfig: kubeConfig})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to Kubernetes")
+	}
+
+	type result struct {
+		target ForwardTarget
+		fw     *Forwarder
+		err    error
+	}
+	results := make(chan result, len(targets))
+	for _, target := range targets {
+		go func(target ForwardTarget) {
+			fw, err := StartWithClient(ctx, config, clientset, SetupOptions{
+				KubeConfig:    kubeConfig,
+				Namespace:     target.Namespace,
+				LabelSelector: target.LabelSelector,
+				LocalPort:     target.LocalPort,
+			})
+			results <- result{target: target, fw: fw, err: err}
+		}(target)
+	}
+
+	forwarders := make([]*Forwarder, 0, len(targets))
+	ports := make(map[string]int)
+	var firstErr error
+	for range targets {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrap(r.err, fmt.Sprintf("Error forwarding to %v", r.target.LabelSelector))
+			}
+			continue
+		}
+		forwarders = append(forwarders, r.fw)
+		ports[r.target.LabelSelector] = r.fw.LocalPort
+	}
+
+	if firstErr != nil {
+		for _, fw := range forwarders {
+			fw.Stop()
+		}
+		return nil, firstErr
+	}
+	return ports, nil
+}
+
+// startAnyPod starts forwarding localPort like startForward, but if the
+// forward times out getting ready, tries again with another matching
+// pod, up to opts.ReadyAttempts pods in all. listener, if not nil, is
+// used for the first try.
+func startAnyPod(ctx context.Context, config *rest.Config, clientset kubernetes.Interface,
+	opts SetupOptions, localPort int, listener net.Listener) (*Forwarder, error) {
+	for attempt := 1; ; attempt++ {
+		attemptOpts := opts
+		dial := func(stopChannel <-chan struct{}) (*podConnection, error) {
+			return dialPod(config, clientset, attemptOpts, localPort, stopChannel)
+		}
+		fw, err := startForward(ctx, dial, opts, localPort, listener)
+		listener = nil
+		timeoutErr, ok := err.(*readyTimeoutError)
+		if !ok || attempt >= opts.ReadyAttempts || len(timeoutErr.pod.Name) == 0 {
+			return fw, err
+		}
+		opts.logger().Verbose(2, "Port forward to pod %v didn't get ready, trying another pod: %v", timeoutErr.pod, err)
+
+		// the local port is free again once the old forward is done
+		select {
+		case <-timeoutErr.done:
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), fmt.Sprintf("Error waiting for port forward %v", localPort))
+		}
+		opts.skipPods = append(opts.skipPods[:len(opts.skipPods):len(opts.skipPods)], timeoutErr.pod)
+	}
+}
+
+// startForward starts forwarding localPort and waits for the forward
+// to accept connections. If listener isn't nil, it's listening on
+// localPort and the forward takes it over; otherwise localPort is bound
+// once connected to the pod.
+func startForward(ctx context.Context, dial dialFunc,
+	opts SetupOptions, localPort int, listener net.Listener) (*Forwarder, error) {
+	// There's no need to check that localPort is still free first: if
+	// someone else took it, binding it fails with a bindError, which
+	// the caller handles.
+	fw := makeForwarder(opts.BindAddress, localPort)
+	if opts.CountBytes {
+		fw.bytes = &byteCounts{}
+	}
+	startTime := time.Now()
+	forwardsStarted.Inc()
+
+	opts.logger().Verbose(2, "Starting port forward from local port %v", localPort)
+	opts.stage(StageStartingForward)
+	errChan := make(chan error, 1)
+	fw.track()
+	go func() {
+		defer close(fw.doneChannel)
+		defer fw.untrack()
+		err := func() (err error) {
+			defer recoverPanic(&err)
+			return runPortForward(dial, opts, localPort, listener, fw)
+		}()
+		fw.err = err
+		fw.setStatus(StateStopped, err)
+		if fw.bytes != nil {
+			opts.logger().Verbose(2, "Port forward from local port %v copied %v bytes in and %v bytes out",
+				localPort, fw.BytesIn(), fw.BytesOut())
+		}
+		if opts.OnDisconnect != nil && fw.ready() {
+			opts.OnDisconnect(err)
 		}
+		errChan <- err
 	}()
 
-	log.Verbose(2, "Waiting for port forward %v to start...", localPort)
+	// stop the forward once ctx is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			fw.stop()
+		case <-fw.doneChannel:
+		}
+	}()
+
+	opts.logger().Verbose(2, "Waiting for port forward %v to start...", localPort)
+	opts.stage(StageWaitingForReady)
+	var timeout <-chan time.Time
+	if opts.ReadyTimeout > 0 {
+		timeout = time.After(opts.ReadyTimeout)
+	}
+	readyChannel := fw.readyChannel
+	var probe <-chan time.Time
+	var probeErr error
+	backoff := makePollBackoff(opts.PollInterval)
 	for {
-		conn, _ := net.DialTimeout("tcp",
-			net.JoinHostPort("", localPort), time.Millisecond)
-		if conn != nil {
-			conn.Close()
+		select {
+		case <-readyChannel:
+			readyChannel = nil
+		case <-probe:
+		case <-timeout:
+			fw.stop()
+			msg := fmt.Sprintf("Timed out after %v waiting for port forward %v to start", opts.ReadyTimeout, localPort)
+			err := errors.New(msg)
+			if probeErr != nil {
+				err = errors.Wrap(probeErr, msg)
+			}
+			info := fw.Info()
+			return nil, &readyTimeoutError{
+				pod:  PodRef{Namespace: info.PodNamespace, Name: info.PodName},
+				done: fw.doneChannel,
+				err:  err,
+			}
+		case err := <-errChan:
+			if err == nil {
+				err = errors.New("Port forward exited before it was ready")
+			}
+			return nil, errors.Wrap(err, "Error forwarding to controller port")
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), fmt.Sprintf("Error waiting for port forward %v", localPort))
+		}
+
+		// The listener accepting connections doesn't mean the server
+		// behind the forward is up, so with a probe wait for that too.
+		if opts.ReadyProbe == nil {
+			break
+		}
+		probeErr = opts.ReadyProbe(localPort)
+		if probeErr == nil {
 			break
 		}
-		time.Sleep(time.Millisecond * 50)
+		opts.logger().Verbose(2, "Port forward %v isn't ready yet (%v): %v", localPort, dialErrorKind(probeErr), probeErr)
+		probe = time.After(backoff.next())
 	}
 
-	log.Verbose(2, "Port forward from local port %v started", localPort)
+	forwardReadyDuration.Observe(time.Since(startTime).Seconds())
+	opts.stage(StageReady)
 
-	return localPort
+	if opts.OnReady != nil {
+		opts.OnReady(localPort)
+	}
+
+	// The forward is up; there's no one left to return an error to, so
+	// just report it if the forward fails later on.
+	go func() {
+		err := <-errChan
+		if err != nil {
+			opts.logger().Warn(fmt.Sprintf("Error forwarding to controller port: %s", err.Error()))
+		}
+	}()
+
+	opts.logger().Verbose(2, "Port forward from local port %v started", localPort)
+
+	return fw, nil
 }
 
-func findFreePort() (string, error) {
-	listener, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return "", err
+// FreePort returns a free port on 127.0.0.1 along with a listener
+// holding it, so the port stays reserved until the caller closes the
+// listener or uses it.
+func FreePort() (int, net.Listener, error) {
+	return listenFreePort(defaultBindAddress, PortRange{})
+}
+
+// FreePortNumber returns a free port on 127.0.0.1. Unlike FreePort it
+// doesn't hold on to the port, so it may be taken by the time it's used.
+func FreePortNumber() (int, error) {
+	return findFreePort(defaultBindAddress, PortRange{})
+}
+
+// listenNetwork returns the network to listen on bindAddress with:
+// IPv4 or IPv6 only for an address of that family, so a free port is
+// picked, and later bound, on the same stack. Host names may resolve
+// to either.
+func listenNetwork(bindAddress string) string {
+	ip := net.ParseIP(bindAddress)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// dialAddress returns the address to connect to a listener on
+// bindAddress at. That's loopback for the unspecified addresses, e.g.
+// 0.0.0.0, which Windows doesn't connect to.
+func dialAddress(bindAddress string) string {
+	ip := net.ParseIP(bindAddress)
+	switch {
+	case len(bindAddress) > 0 && (ip == nil || !ip.IsUnspecified()):
+		return bindAddress
+	case ip != nil && ip.To4() == nil:
+		return "::1"
+	default:
+		return "127.0.0.1"
+	}
+}
+
+func listenFreePort(bindAddress string, portRange PortRange) (int, net.Listener, error) {
+	network := listenNetwork(bindAddress)
+	if portRange.Low == 0 && portRange.High == 0 {
+		listener, err := net.Listen(network, net.JoinHostPort(bindAddress, "0"))
+		if err != nil {
+			return 0, nil, err
+		}
+		return listener.Addr().(*net.TCPAddr).Port, listener, nil
 	}
 
-	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	if portRange.Low <= 0 || portRange.High < portRange.Low || portRange.High > 65535 {
+		return 0, nil, errors.New(fmt.Sprintf("Invalid port range %v", portRange))
+	}
+	for port := portRange.Low; port <= portRange.High; port++ {
+		listener, err := net.Listen(network, net.JoinHostPort(bindAddress, strconv.Itoa(port)))
+		if err == nil {
+			return port, listener, nil
+		}
+	}
+	return 0, nil, errors.New(fmt.Sprintf("No free port in range %v", portRange))
+}
+
+func findFreePort(bindAddress string, portRange PortRange) (int, error) {
+	port, listener, err := listenFreePort(bindAddress, portRange)
+	if err != nil {
+		return 0, err
+	}
 
 	err = listener.Close()
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 
 	return port, nil
 }
 
-// runPortForward creates a local port forward to the specified pod
-func runPortForward(kubeConfig string, labelSelector string, localPort string, ns string) error {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+// podClient returns the client for connecting to a pod's portforward
+// subresource, and the upgrader for the connections it makes. The
+// client authenticates like the config says, including with exec and
+// auth provider plugins.
+func podClient(config *rest.Config, opts SetupOptions) (*http.Client, spdy.Upgrader, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Failed to connect to Kubernetes: %s", err))
+		return nil, nil, err
+	}
+	client := &http.Client{Transport: transport}
+	if opts.MakeHTTPClient != nil {
+		client = opts.MakeHTTPClient(transport)
+	}
+	return client, upgrader, nil
+}
+
+// upgradeConnection sends the request to port forward to url and
+// upgrades the connection to SPDY, giving up after opts.DialTimeout if
+// it's set.
+//
+// This is what spdy.NewDialer's Dial does, except that it keeps errors
+// sending the request as they are, rather than formatting them into new
+// ones, so network errors are retried.
+func upgradeConnection(client *http.Client, upgrader spdy.Upgrader, url string, opts SetupOptions) (httpstream.Connection, error) {
+	upgrade := func() (httpstream.Connection, error) {
+		req, err := upgradeRequest(url, opts)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		streamConn, err := upgrader.NewConnection(resp)
+		if err != nil && resp.StatusCode == http.StatusForbidden {
+			return nil, errors.Wrap(ErrForbidden, err.Error())
+		}
+		if err != nil {
+			return nil, &upgradeError{err: err}
+		}
+		return streamConn, nil
+	}
+	if opts.DialTimeout == 0 {
+		return upgrade()
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	// The SPDY round tripper doesn't take a context or a deadline, so
+	// leave it running and close the connection if it ever comes up.
+	type result struct {
+		streamConn httpstream.Connection
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		streamConn, err := upgrade()
+		done <- result{streamConn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.streamConn, r.err
+	case <-time.After(opts.DialTimeout):
+		go func() {
+			if r := <-done; r.streamConn != nil {
+				r.streamConn.Close()
+			}
+		}()
+		return nil, errors.New(fmt.Sprintf("Timed out after %v connecting to %v", opts.DialTimeout, url))
+	}
+}
+
+// upgradeRequest returns the request to upgrade the connection to the
+// pod at url to SPDY, with opts.UpgradeHeaders.
+func upgradeRequest(url string, opts SetupOptions) (*http.Request, error) {
+	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Failed to connect to Kubernetes: %s", err))
+		return nil, err
 	}
+	for name, value := range opts.UpgradeHeaders {
+		req.Header.Set(name, value)
+	}
+	req.Header.Add(httpstream.HeaderProtocolVersion, portforward.PortForwardProtocolV1Name)
+	return req, nil
+}
 
-	log.Verbose(2, "Connected to Kubernetes API")
+// upgradeError means the API server answered the request to port
+// forward, but the connection couldn't be upgraded to SPDY.
+type upgradeError struct {
+	err error
+}
+
+func (err *upgradeError) Error() string {
+	return err.err.Error()
+}
 
-	// if namespace is unset, try to find a pod in any namespace
-	if len(ns) == 0 {
-		ns = meta_v1.NamespaceAll
+// dialErrorKind says how a connection failed, for telling apart in the
+// logs why a forward never gets ready: "connection refused",
+// "connection reset", "timed out", or "failed" for anything else.
+func dialErrorKind(err error) string {
+	err = errors.Cause(err)
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timed out"
 	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return "connection refused"
+	case syscall.ECONNRESET:
+		return "connection reset"
+	}
+	return "failed"
+}
 
-	// get the pod; if there is more than one, ask the user to disambiguate
-	podList, err := clientset.CoreV1().Pods(ns).
-		List(meta_v1.ListOptions{LabelSelector: labelSelector})
-	if err != nil || len(podList.Items) == 0 {
-		log.Fatal("Error getting controller pod for port-forwarding")
+// recoverPanic turns a panic in the function deferring it into an error
+// in *err, with the stack, so that a misbehaving connection to the pod
+// fails the forward rather than the whole process.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = panicError(r)
 	}
+}
+
+// panicError returns an error for the recovered panic r, with the stack.
+func panicError(r interface{}) error {
+	return errors.New(fmt.Sprintf("Port forward panicked: %v\n%s", r, debug.Stack()))
+}
+
+// readyTimeoutError means a forward to pod timed out getting ready. done
+// is closed once the forward has stopped.
+type readyTimeoutError struct {
+	pod  PodRef
+	done <-chan struct{}
+	err  error
+}
+
+func (err *readyTimeoutError) Error() string {
+	return err.err.Error()
+}
+
+// Cause lets errors.Cause see through to why the forward wasn't ready.
+func (err *readyTimeoutError) Cause() error {
+	return err.err
+}
+
+// bindError means the local port was taken by someone else before the
+// forwarder could listen on it.
+type bindError struct {
+	localPort int
+	err       error
+}
+
+func (err *bindError) Error() string {
+	return fmt.Sprintf("Error listening on local port %v: %v", err.localPort, err.err)
+}
 
-	// make a useful error message if there is more than one install
-	if len(podList.Items) > 1 {
-		namespaces := make([]string, 0)
-		for _, p := range podList.Items {
-			namespaces = append(namespaces, p.Namespace)
+// checkPortFree returns an error if localPort can't be bound on
+// bindAddress.
+func checkPortFree(bindAddress string, localPort int) error {
+	listener, err := net.Listen(listenNetwork(bindAddress), net.JoinHostPort(bindAddress, strconv.Itoa(localPort)))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Local port %v is already in use", localPort))
+	}
+	return listener.Close()
+}
+
+// runPortForward creates a local port forward to the specified pod,
+// accepting connections on listener, or on localPort if it's nil. The
+// forward runs until fw is stopped.
+func runPortForward(dial dialFunc, opts SetupOptions, localPort int, listener net.Listener, fw *Forwarder) error {
+	conn, err := dial(fw.stopChannel)
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return err
+	}
+	fw.setConnection(conn)
+
+	localAddr := net.JoinHostPort(opts.BindAddress, strconv.Itoa(localPort))
+	if listener == nil {
+		listener, err = net.Listen(listenNetwork(opts.BindAddress), localAddr)
+		if err != nil {
+			conn.streamConn.Close()
+			return &bindError{localPort: localPort, err: err}
+		}
+	}
+	defer listener.Close()
+	fw.setListener(listener)
+	fw.addListener(listener)
+
+	pf := &portForwarder{
+		listener: listener,
+		logger:   opts.logger(),
+		out:      opts.OutStream,
+		errOut:   opts.ErrStream,
+		bytes:    fw.bytes,
+		conns:    fw.conns,
+		conn:     conn,
+	}
+
+	if opts.CheckRemotePort {
+		err = pf.checkRemotePort(conn)
+		if err != nil {
+			conn.streamConn.Close()
+			return errors.Wrap(ErrRemotePortClosed, fmt.Sprintf("Error connecting to port %v on pod %v/%v: %v",
+				conn.remotePort, conn.podNamespace, conn.podName, err))
+		}
+	}
+
+	// the extra ports go over the same connection to the pod
+	extras := make([]*portForwarder, 0, len(opts.ExtraRemotePorts))
+	defer func() {
+		for _, extra := range extras {
+			extra.listener.Close()
 		}
-		log.Fatal(fmt.Sprintf("Found %v fission installs, set FISSION_NAMESPACE to one of: %v",
-			len(podList.Items), strings.Join(namespaces, " ")))
+	}()
+	extraPorts := make([]ForwardedPort, 0, len(opts.ExtraRemotePorts))
+	for _, remotePort := range opts.ExtraRemotePorts {
+		extraPort, extraListener, err := listenFreePort(opts.BindAddress, opts.PortRange)
+		if err != nil {
+			conn.streamConn.Close()
+			return errors.Wrap(err, fmt.Sprintf("Error listening to forward port %v", remotePort))
+		}
+		extras = append(extras, &portForwarder{
+			listener: extraListener,
+			logger:   opts.logger(),
+			out:      opts.OutStream,
+			errOut:   opts.ErrStream,
+			bytes:    fw.bytes,
+			conns:    fw.conns,
+			conn:     conn.withPort(remotePort),
+		})
+		fw.addListener(extraListener)
+		extraPorts = append(extraPorts, ForwardedPort{Local: uint16(extraPort), Remote: uint16(remotePort)})
 	}
+	fw.setExtraPorts(extraPorts)
 
-	// pick the first pod
-	podName := podList.Items[0].Name
-	podNameSpace := podList.Items[0].Namespace
+	setConnection := func(conn *podConnection) {
+		pf.setConnection(conn)
+		for i, extra := range extras {
+			extra.setConnection(conn.withPort(opts.ExtraRemotePorts[i]))
+		}
+		fw.setConnection(conn)
+	}
+	streamErrors := func() []error {
+		errs := pf.streamErrors()
+		for _, extra := range extras {
+			errs = append(errs, extra.streamErrors()...)
+		}
+		return errs
+	}
 
-	// get the service and the target port
-	svcs, err := clientset.CoreV1().Services(podNameSpace).
-		List(meta_v1.ListOptions{LabelSelector: labelSelector})
+	opts.logger().Verbose(2, "Starting port forwarder from %v", localAddr)
+	fw.conns.add(1)
+	go pf.serve()
+	for _, extra := range extras {
+		opts.logger().Verbose(2, "Starting port forwarder from %v to port %v", extra.listener.Addr(), extra.conn.remotePort)
+		fw.conns.add(1)
+		go extra.serve()
+	}
+	fw.setStatus(StateHealthy, nil)
+	close(fw.readyChannel)
+
+	forwardsActive.Inc()
+	defer forwardsActive.Dec()
+
+	var keepalive <-chan time.Time
+	probeFailed := make(chan *podConnection, 1)
+	if opts.Keepalive > 0 {
+		ticker := time.NewTicker(opts.Keepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	var lifetime <-chan time.Time
+	resetLifetime := func() {
+		if opts.MaxLifetime > 0 {
+			lifetime = time.After(opts.MaxLifetime)
+		}
+	}
+	resetLifetime()
+
+	// restart switches new connections over to a new connection to the
+	// pod, leaving the old one in place if that fails. With drain, the
+	// old one is closed once the connections using it are done, or
+	// after restartDrainTimeout; otherwise right away.
+	restart := func(drain bool) error {
+		newConn, err := dial(fw.stopChannel)
+		if err != nil {
+			return err
+		}
+		oldConn := conn
+		conn = newConn
+		setConnection(conn)
+		if drain {
+			go drainConnection(oldConn, restartDrainTimeout, fw.stopChannel)
+		} else {
+			oldConn.streamConn.Close()
+		}
+		resetLifetime()
+		forwardReconnects.Inc()
+		opts.logger().Verbose(2, "Restarted port forward to pod %v/%v", conn.podNamespace, conn.podName)
+		return nil
+	}
+
+	for {
+		// wait for a stop or for the connection to go away
+		select {
+		case <-fw.stopChannel:
+			conn.streamConn.Close()
+			return nil
+		case <-keepalive:
+			go func(conn *podConnection) {
+				err := pf.probe(conn)
+				if err != nil {
+					pf.logError(errors.Wrap(err, "Keepalive probe failed"))
+					select {
+					case probeFailed <- conn:
+					default:
+					}
+				}
+			}(conn)
+			continue
+		case failedConn := <-probeFailed:
+			if failedConn != conn {
+				// already replaced
+				continue
+			}
+			err := restart(false)
+			if err != nil {
+				// reconnected, or the forward failed, below
+				opts.logger().Verbose(2, "Error restarting port forward after a failed keepalive probe: %v", err)
+				conn.streamConn.Close()
+			}
+			continue
+		case reply := <-fw.restartChannel:
+			reply <- restart(true)
+			continue
+		case <-lifetime:
+			opts.logger().Verbose(2, "Connection to pod %v/%v is %v old, restarting", conn.podNamespace, conn.podName, opts.MaxLifetime)
+			err := restart(true)
+			if err != nil {
+				opts.logger().Warn(fmt.Sprintf("Error restarting port forward, retrying in %v: %v", maxReconnectInterval, err))
+				lifetime = time.After(maxReconnectInterval)
+			}
+			continue
+		case <-conn.streamConn.CloseChan():
+		}
+
+		lostErr := errors.New(fmt.Sprintf("Lost connection to pod %v/%v", conn.podNamespace, conn.podName))
+		if !opts.Reconnect {
+			return &ForwardError{
+				Err:          lostErr,
+				StreamErrors: streamErrors(),
+			}
+		}
+		fw.setStatus(StateReconnecting, lostErr)
+		opts.logger().Verbose(2, "Lost connection to pod %v/%v, reconnecting", conn.podNamespace, conn.podName)
+
+		// The listener stays open while we reconnect, so the local port
+		// doesn't change; connections made in the meantime are dropped.
+		backoff := reconnectInterval
+		for {
+			select {
+			case <-fw.stopChannel:
+				return nil
+			case <-time.After(backoff):
+			}
+
+			conn, err = dial(fw.stopChannel)
+			if err == nil {
+				break
+			}
+			opts.logger().Verbose(2, "Error reconnecting port forward: %v", err)
+			fw.setStatus(StateReconnecting, err)
+
+			backoff *= 2
+			if backoff > maxReconnectInterval {
+				backoff = maxReconnectInterval
+			}
+		}
+		setConnection(conn)
+		resetLifetime()
+		fw.setStatus(StateHealthy, nil)
+		forwardReconnects.Inc()
+		opts.logger().Verbose(2, "Reconnected to pod %v/%v", conn.podNamespace, conn.podName)
+	}
+}
+
+// dialFunc connects to the pod to forward to, giving up when
+// stopChannel is closed. It's dialPod outside of tests.
+type dialFunc func(stopChannel <-chan struct{}) (*podConnection, error)
+
+// dialPod picks the pod to forward to and opens an upgraded connection
+// to its portforward subresource. It gives up waiting for the container
+// to be ready when stopChannel is closed.
+func dialPod(config *rest.Config, clientset kubernetes.Interface, opts SetupOptions,
+	localPort int, stopChannel <-chan struct{}) (*podConnection, error) {
+	opts.stage(StageResolvingPod)
+	t, err := resolveTarget(clientset, opts)
+	if opts.WaitForPod > 0 && noPodsYet(err) {
+		opts.logger().Verbose(2, "No ready pod yet, waiting up to %v: %v", opts.WaitForPod, err)
+		err = waitForReadyPod(clientset, opts, stopChannel)
+		if err != nil {
+			return nil, err
+		}
+		t, err = resolveTarget(clientset, opts)
+	}
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error getting %v service :%v", labelSelector, err.Error()))
+		return nil, err
+	}
+	if opts.WaitForContainer {
+		err = waitForContainer(clientset, opts, t, stopChannel)
+		if err != nil {
+			return nil, err
+		}
 	}
-	if len(svcs.Items) == 0 {
-		log.Fatal(fmt.Sprintf("Service %v not found", labelSelector))
+	err = checkNode(clientset, opts, t.pod)
+	if err != nil {
+		return nil, err
 	}
-	service := &svcs.Items[0]
+	podName, podNameSpace := t.pod.Name, t.pod.Namespace
+	opts.logger().Verbose(2, "Connecting local port %v to port %v on pod %v/%v", localPort, t.remotePort, podNameSpace, podName)
 
-	var targetPort string
-	for _, servicePort := range service.Spec.Ports {
-		targetPort = servicePort.TargetPort.String()
+	opts.stage(StageConnecting)
+	upgrade := opts.upgrade
+	if upgrade == nil {
+		upgrade = func(podNameSpace, podName string) (httpstream.Connection, error) {
+			return upgradePod(config, clientset, opts, podNameSpace, podName)
+		}
+	}
+	streamConn, err := upgrade(podNameSpace, podName)
+	if err != nil {
+		return nil, err
 	}
-	log.Verbose(2, "Connecting to port %v on pod %v/%v", targetPort, podNameSpace, podNameSpace)
 
-	stopChannel := make(chan struct{}, 1)
-	readyChannel := make(chan struct{})
+	return &podConnection{
+		podName:      podName,
+		podNamespace: podNameSpace,
+		remotePort:   t.remotePort,
+		service:      t.service,
+		streamConn:   streamConn,
+		active:       &connCount{},
+	}, nil
+}
 
+// upgradePod opens an upgraded connection to the portforward
+// subresource of the pod podName in podNameSpace.
+func upgradePod(config *rest.Config, clientset kubernetes.Interface, opts SetupOptions,
+	podNameSpace, podName string) (httpstream.Connection, error) {
 	// create request URL
 	req := clientset.CoreV1().RESTClient().Post().Resource("pods").
 		Namespace(podNameSpace).Name(podName).SubResource("portforward")
 	url := req.URL()
 
-	// create ports slice
-	portCombo := localPort + ":" + targetPort
-	ports := []string{portCombo}
+	// The SPDY transport dials through the proxy from HTTPS_PROXY and
+	// friends, honoring NO_PROXY, same as kubectl; it has no way to
+	// set a different proxy. Say which one is used since that's easy
+	// to get wrong.
+	proxyURL, err := utilnet.NewProxierWithNoProxyCIDR(http.ProxyFromEnvironment)(&http.Request{URL: url})
+	if err == nil && proxyURL != nil {
+		opts.logger().Verbose(2, "Connecting to %v through proxy %v", url.Host, proxyURL.Host)
+	}
 
 	// actually start the port-forwarding process here
-	transport, upgrader, err := spdy.RoundTripperFor(config)
+	client, upgrader, err := podClient(config, opts)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to connect to Fission service on Kubernetes: %v", err.Error())
-		log.Fatal(msg)
+		return nil, errors.Wrap(err, "Failed to connect to Fission service on Kubernetes")
 	}
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", url)
 
-	outStream := os.Stdout
-	if log.Verbosity < 2 {
-		outStream = nil
+	var streamConn httpstream.Connection
+	err = retryAPI(opts, func() error {
+		var err error
+		streamConn, err = upgradeConnection(client, upgrader, url.String(), opts)
+		return err
+	})
+	if upgradeErr, ok := err.(*upgradeError); ok {
+		// The vendored client-go can only port forward over SPDY, so
+		// there's no falling back to websockets like newer kubectls
+		// do; let the caller know what probably went wrong instead.
+		return nil, errors.Wrap(ErrUpgradeFailed, upgradeErr.err.Error())
+	}
+	if errors.Cause(err) == ErrForbidden {
+		// RBAC is often set up to allow listing pods but not this
+		return nil, errors.Wrap(err, fmt.Sprintf("Port forwarding to pod %v/%v needs permission to create pods/portforward in namespace %v",
+			podNameSpace, podName, podNameSpace))
 	}
-	fw, err := portforward.New(dialer, ports, stopChannel, readyChannel, outStream, os.Stderr)
 	if err != nil {
-		msg := fmt.Sprintf("portforward.new errored out :%v", err.Error())
-		log.Fatal(msg)
+		return nil, errors.Wrap(err, "Error upgrading connection")
 	}
+	return streamConn, nil
+}
 
-	log.Verbose(2, "Starting port forwarder")
-	return fw.ForwardPorts()
+// drainConnection closes conn once nothing is forwarded over it any
+// more, after timeout, or once stopChannel is closed, whichever is
+// first.
+func drainConnection(conn *podConnection, timeout time.Duration, stopChannel <-chan struct{}) {
+	select {
+	case <-conn.active.idle():
+	case <-time.After(timeout):
+	case <-stopChannel:
+	}
+	conn.streamConn.Close()
 }
@@ -0,0 +1,1024 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/portforward"
+)
+
+func TestDryRun(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestService("fission", makeTestServicePort("http", 8888)))
+
+	var stages []string
+	fw, err := StartWithClient(context.Background(), &rest.Config{}, clientset, SetupOptions{
+		LabelSelector: testSelector,
+		DryRun:        true,
+		OnStage: func(stage string) {
+			stages = append(stages, stage)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case <-fw.Ready():
+		t.Errorf("Expected a dry run never to be ready")
+	case <-fw.Done():
+	}
+	// a dry run isn't running, so this must not block
+	fw.Stop()
+	if err := fw.Wait(); err != nil {
+		t.Errorf("Expected a dry run to end cleanly, got %v", err)
+	}
+	if err := fw.Restart(); err == nil {
+		t.Errorf("Expected an error restarting a dry run")
+	}
+	if _, err := fw.Ports(); err == nil {
+		t.Errorf("Expected an error getting the ports of a dry run")
+	}
+
+	info := fw.Info()
+	if info.PodName != "controller-1" || info.PodNamespace != "fission" {
+		t.Errorf("Expected pod fission/controller-1, got %v/%v", info.PodNamespace, info.PodName)
+	}
+	if info.TargetPort != 8888 {
+		t.Errorf("Expected target port 8888, got %v", info.TargetPort)
+	}
+	if info.Service == nil || info.Service.Name != "controller" {
+		t.Errorf("Expected the controller service, got %v", info.Service)
+	}
+	if info.LocalPort == 0 {
+		t.Errorf("Expected a local port to be picked")
+	}
+	if status := fw.Status(); status.State != StateStopped || status.Err != nil {
+		t.Errorf("Expected a dry run to be stopped cleanly, got %v", status)
+	}
+	if len(stages) != 1 || stages[0] != StageResolvingPod {
+		t.Errorf("Expected only the %q stage, got %v", StageResolvingPod, stages)
+	}
+}
+
+func TestSetupManyDuplicateSelectors(t *testing.T) {
+	// the ports are returned by selector, so one forward's would be lost
+	_, err := SetupMany(context.Background(), "/nonexistent", []ForwardTarget{
+		{Namespace: "fission", LabelSelector: "application=fission-router"},
+		{Namespace: "fission-2", LabelSelector: "application=fission-router"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "More than one target") {
+		t.Errorf("Expected an error for targets sharing a selector, got %v", err)
+	}
+}
+
+func TestFreePort(t *testing.T) {
+	port, listener, err := FreePort()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	// the port is held until the listener is closed
+	_, err = net.Listen("tcp", net.JoinHostPort(defaultBindAddress, strconv.Itoa(port)))
+	if err == nil {
+		t.Errorf("Expected port %v to be held by the listener", port)
+	}
+}
+
+func TestForwarderDialContext(t *testing.T) {
+	port, listener, err := FreePort()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	fw := makeForwarder(defaultBindAddress, port)
+	fw.setListener(listener)
+	close(fw.readyChannel)
+	ports, err := fw.Ports()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ports) != 1 || int(ports[0].Local) != port {
+		t.Errorf("Expected local port %v, got %v", port, ports)
+	}
+
+	conn, err := fw.DialContext(context.Background(), "tcp", "controller.fission:80")
+	if err != nil {
+		t.Fatalf("Error dialing the forward: %v", err)
+	}
+	defer conn.Close()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting: %v", err)
+	}
+	accepted.Close()
+}
+
+func TestForwarderLocalURLUnspecified(t *testing.T) {
+	tests := []struct {
+		bindAddress string
+		expected    string
+	}{
+		{"0.0.0.0", "http://127.0.0.1:8888"},
+		{"::", "http://[::1]:8888"},
+		{"", "http://127.0.0.1:8888"},
+		{"192.168.1.10", "http://192.168.1.10:8888"},
+		{"localhost", "http://localhost:8888"},
+	}
+	for _, test := range tests {
+		fw := makeForwarder(test.bindAddress, 8888)
+		if url := fw.LocalURL("http"); url != test.expected {
+			t.Errorf("Bind address %q: expected %v, got %v", test.bindAddress, test.expected, url)
+		}
+	}
+}
+
+func TestForwarderLocalAddr(t *testing.T) {
+	fw := makeForwarder("::1", 8888)
+	if url := fw.LocalURL("http"); url != "http://[::1]:8888" {
+		t.Errorf("Expected http://[::1]:8888, got %v", url)
+	}
+	if addr := fw.LocalAddr().String(); addr != "[::1]:8888" {
+		t.Errorf("Expected [::1]:8888, got %v", addr)
+	}
+}
+
+func TestForwarderExtraPorts(t *testing.T) {
+	fw := makeForwarder(defaultBindAddress, 34567)
+	fw.setConnection(&podConnection{podName: "controller", podNamespace: "fission", remotePort: 8888})
+	fw.setExtraPorts([]ForwardedPort{{Local: 34568, Remote: 6060}})
+	close(fw.readyChannel)
+
+	ports, err := fw.Ports()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []ForwardedPort{{Local: 34567, Remote: 8888}, {Local: 34568, Remote: 6060}}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected %v, got %v", expected, ports)
+	}
+}
+
+func TestForwarderUsePort(t *testing.T) {
+	// the forward asked for port 8888, but its listener got another
+	port, listener, err := listenFreePort(defaultBindAddress, PortRange{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener.Close()
+	fw := makeForwarder(defaultBindAddress, 8888)
+
+	if _, err := fw.UsePort(); err == nil {
+		t.Errorf("Expected an error before the forward is ready")
+	}
+
+	fw.setListener(listener)
+	close(fw.readyChannel)
+	usePort, err := fw.UsePort()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if usePort != port {
+		t.Errorf("Expected the listener's port %v, got %v", port, usePort)
+	}
+	if addr := fw.LocalAddr().String(); addr != listener.Addr().String() {
+		t.Errorf("Expected the listener's address %v, got %v", listener.Addr(), addr)
+	}
+}
+
+func TestPodClientUsesExecCredentials(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	config := &rest.Config{
+		Host: server.URL,
+		ExecProvider: &clientcmdapi.ExecConfig{
+			APIVersion: "client.authentication.k8s.io/v1alpha1",
+			Command:    "sh",
+			Args: []string{"-c", `echo '{"apiVersion": "client.authentication.k8s.io/v1alpha1", ` +
+				`"kind": "ExecCredential", "status": {"token": "exec-token"}}'`},
+		},
+	}
+	client, _, err := podClient(config, SetupOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if auth != "Bearer exec-token" {
+		t.Errorf("Expected the exec plugin's token, got %q", auth)
+	}
+}
+
+func TestUpgradeRequestHeaders(t *testing.T) {
+	req, err := upgradeRequest("https://kubernetes/api/v1/namespaces/fission/pods/controller-1/portforward", SetupOptions{
+		UpgradeHeaders: map[string]string{"X-Auth": "gateway-token"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if auth := req.Header.Get("X-Auth"); auth != "gateway-token" {
+		t.Errorf("Expected the X-Auth header, got %q", auth)
+	}
+	if protocol := req.Header.Get(httpstream.HeaderProtocolVersion); protocol != portforward.PortForwardProtocolV1Name {
+		t.Errorf("Expected protocol %v, got %q", portforward.PortForwardProtocolV1Name, protocol)
+	}
+}
+
+func TestUpgradeConnectionDialTimeout(t *testing.T) {
+	// a server that never answers the upgrade
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	opts := SetupOptions{DialTimeout: 50 * time.Millisecond}
+	client, upgrader, err := podClient(&rest.Config{Host: server.URL}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	_, err = upgradeConnection(client, upgrader, server.URL, opts)
+	if err == nil {
+		t.Fatalf("Expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected to give up after the dial timeout, took %v", elapsed)
+	}
+}
+
+func TestUpgradeConnectionForbidden(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Forbidden", "code": 403, `+
+			`"message": "pods controller-1 is forbidden: cannot create pods/portforward"}`)
+	}))
+	defer server.Close()
+
+	client, upgrader, err := podClient(&rest.Config{Host: server.URL}, SetupOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = upgradeConnection(client, upgrader, server.URL, SetupOptions{})
+	if errors.Cause(err) != ErrForbidden {
+		t.Errorf("Expected ErrForbidden, got %v", err)
+	}
+}
+
+func TestListenFreePortHeld(t *testing.T) {
+	// two forwards set up at once get their own ports, and hold on to
+	// them until they're forwarding
+	port1, listener1, err := listenFreePort(defaultBindAddress, PortRange{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener1.Close()
+	port2, listener2, err := listenFreePort(defaultBindAddress, PortRange{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener2.Close()
+
+	if port1 == port2 {
+		t.Errorf("Expected different ports, got %v twice", port1)
+	}
+	for _, port := range []int{port1, port2} {
+		if err := checkPortFree(defaultBindAddress, port); err == nil {
+			t.Errorf("Expected port %v to be held", port)
+		}
+	}
+}
+
+// freePortPair returns a free port whose next port is free too.
+func freePortPair(t *testing.T) int {
+	for {
+		port, err := findFreePort(defaultBindAddress, PortRange{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if port < 65535 && checkPortFree(defaultBindAddress, port+1) == nil {
+			return port
+		}
+	}
+}
+
+func TestListenFreePortRange(t *testing.T) {
+	// a couple of free ports next to each other to use as the range
+	low := freePortPair(t)
+	portRange := PortRange{Low: low, High: low + 1}
+
+	port1, listener1, err := listenFreePort(defaultBindAddress, portRange)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener1.Close()
+	port2, listener2, err := listenFreePort(defaultBindAddress, portRange)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer listener2.Close()
+	if port1 != low || port2 != low+1 {
+		t.Errorf("Expected ports %v and %v, got %v and %v", low, low+1, port1, port2)
+	}
+
+	_, _, err = listenFreePort(defaultBindAddress, portRange)
+	if err == nil {
+		t.Errorf("Expected an error with the range used up")
+	}
+	_, _, err = listenFreePort(defaultBindAddress, PortRange{Low: 9000, High: 8000})
+	if err == nil {
+		t.Errorf("Expected an error for an invalid range")
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	tests := []struct {
+		bindAddress string
+		expect      string
+	}{
+		{bindAddress: "127.0.0.1", expect: "tcp4"},
+		{bindAddress: "0.0.0.0", expect: "tcp4"},
+		{bindAddress: "::1", expect: "tcp6"},
+		{bindAddress: "::", expect: "tcp6"},
+		{bindAddress: "localhost", expect: "tcp"},
+	}
+	for _, test := range tests {
+		if network := listenNetwork(test.bindAddress); network != test.expect {
+			t.Errorf("%v: expected %v, got %v", test.bindAddress, test.expect, network)
+		}
+	}
+}
+
+func TestFindFreePortIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("No IPv6 loopback: %v", err)
+	}
+	listener.Close()
+
+	port, err := findFreePort("::1", PortRange{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := checkPortFree("::1", port); err != nil {
+		t.Errorf("Expected port %v to be free on ::1, got %v", port, err)
+	}
+}
+
+// testLogger records what's logged to it.
+type testLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Verbose(level int, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Warn(msg interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, fmt.Sprint(msg))
+}
+
+func TestLogger(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestService("fission", makeTestServicePort("http", 8888)))
+
+	logger := &testLogger{}
+	_, err := StartWithClient(context.Background(), &rest.Config{}, clientset, SetupOptions{
+		LabelSelector: testSelector,
+		DryRun:        true,
+		Logger:        logger,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(logger.messages) == 0 || !strings.Contains(logger.messages[len(logger.messages)-1], "Would forward") {
+		t.Errorf("Expected the dry run to be logged, got %v", logger.messages)
+	}
+}
+
+func TestLoggerForwardID(t *testing.T) {
+	logger := &testLogger{}
+	opts := SetupOptions{Logger: logger}.withForwardID()
+	opts.logger().Verbose(2, "Starting port forwarder from %v", "127.0.0.1:8888")
+	opts.withForwardID().logger().Warn("Error forwarding")
+
+	id := opts.Logger.(*forwardLogger).id
+	expected := []string{
+		"[fwd " + id + "] Starting port forwarder from 127.0.0.1:8888",
+		"[fwd " + id + "] Error forwarding",
+	}
+	if len(logger.messages) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, logger.messages)
+	}
+	for i := range expected {
+		if logger.messages[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], logger.messages[i])
+		}
+	}
+}
+
+func TestStartAPITimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer server.Close()
+	defer InvalidateClientCache()
+
+	dir, err := ioutil.TempDir("", "portforward")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	kubeConfig := testConfigHeader + strings.Replace(testClusterConfig, "https://test.example.com:6443", server.URL, 1) + testContextConfig
+	if err := ioutil.WriteFile(path, []byte(kubeConfig), 0600); err != nil {
+		t.Fatalf("Error writing kubeconfig: %v", err)
+	}
+
+	start := time.Now()
+	_, err = Start(context.Background(), SetupOptions{
+		KubeConfig:    path,
+		LabelSelector: testSelector,
+		APITimeout:    50 * time.Millisecond,
+		APIAttempts:   1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "Cannot reach API server") {
+		t.Errorf("Expected an unreachable API server error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("Expected to fail fast, took %v", elapsed)
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	// a forward that finishes once stopped
+	fw := makeForwarder(defaultBindAddress, 0)
+	fw.track()
+	go func() {
+		<-fw.stopChannel
+		fw.untrack()
+		close(fw.doneChannel)
+	}()
+
+	err := CloseAll(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case <-fw.Done():
+	default:
+		t.Errorf("Expected the forward to be stopped")
+	}
+
+	// a forward that's stuck
+	stuck := makeForwarder(defaultBindAddress, 0)
+	stuck.track()
+	defer stuck.untrack()
+	err = CloseAll(10 * time.Millisecond)
+	if err == nil {
+		t.Errorf("Expected a timeout for a forward that doesn't stop")
+	}
+}
+
+func TestStopGraceful(t *testing.T) {
+	port, listener, err := FreePort()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fw := makeForwarder(defaultBindAddress, port)
+	fw.addListener(listener)
+	pf := &portForwarder{listener: listener, logger: &testLogger{}, conns: fw.conns}
+	fw.conns.add(1)
+	go pf.serve()
+	go func() {
+		<-fw.stopChannel
+		close(fw.doneChannel)
+	}()
+
+	// a connection in flight that finishes shortly
+	fw.conns.add(1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		fw.conns.add(-1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = fw.StopGraceful(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case <-fw.Done():
+	default:
+		t.Errorf("Expected the forward to be stopped")
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(defaultBindAddress, strconv.Itoa(port)))
+	if err == nil {
+		conn.Close()
+		t.Errorf("Expected the listener to be closed")
+	}
+
+	// a connection that doesn't finish in time is cut off
+	stuck := makeForwarder(defaultBindAddress, 0)
+	go func() {
+		<-stuck.stopChannel
+		close(stuck.doneChannel)
+	}()
+	stuck.conns.add(1)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = stuck.StopGraceful(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to pass, got %v", err)
+	}
+}
+
+// fakeDialer connects forwards to fake pods, controller-1 and so on,
+// one per dial.
+type fakeDialer struct {
+	lock  sync.Mutex
+	conns []*fakeConnection
+
+	// block, if set, holds up dials until it's closed
+	block chan struct{}
+
+	// brokenFirst makes the first connection fail to create streams
+	brokenFirst bool
+
+	// holdData makes the connections hold data streams open
+	holdData bool
+}
+
+func (d *fakeDialer) dial(stopChannel <-chan struct{}) (*podConnection, error) {
+	d.lock.Lock()
+	block := d.block
+	d.lock.Unlock()
+	if block != nil {
+		select {
+		case <-block:
+		case <-stopChannel:
+			return nil, errors.New("Stopped dialing")
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	conn := &fakeConnection{holdData: d.holdData}
+	if d.brokenFirst && len(d.conns) == 0 {
+		conn.streamErr = errors.New("Connection reset")
+	}
+	d.conns = append(d.conns, conn)
+	return &podConnection{
+		podName:      fmt.Sprintf("controller-%v", len(d.conns)),
+		podNamespace: "fission",
+		remotePort:   8888,
+		streamConn:   conn,
+		active:       &connCount{},
+	}, nil
+}
+
+func (d *fakeDialer) setBlock(block chan struct{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.block = block
+}
+
+// conn returns the connection made by the ith dial, from 1.
+func (d *fakeDialer) conn(i int) *fakeConnection {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.conns[i-1]
+}
+
+func (d *fakeDialer) dials() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.conns)
+}
+
+// fakeUpgrader stands in for the pods' portforward subresources in
+// SetupOptions.upgrade, so StartWithClient can be run against a fake
+// clientset.
+type fakeUpgrader struct {
+	lock  sync.Mutex
+	conns []*fakeConnection
+
+	// upgrading, if set, is sent to as each upgrade starts
+	upgrading chan struct{}
+
+	// block, if set, holds up upgrades until it's closed
+	block chan struct{}
+}
+
+func (u *fakeUpgrader) upgrade(podNamespace, podName string) (httpstream.Connection, error) {
+	if u.upgrading != nil {
+		u.upgrading <- struct{}{}
+	}
+	if u.block != nil {
+		<-u.block
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	conn := &fakeConnection{}
+	u.conns = append(u.conns, conn)
+	return conn, nil
+}
+
+// conn returns the ith connection opened, from 1.
+func (u *fakeUpgrader) conn(i int) *fakeConnection {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.conns[i-1]
+}
+
+// waitFor waits up to 5s for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startTestPortForward starts a forward through d on a free port.
+func startTestPortForward(t *testing.T, d *fakeDialer, opts SetupOptions) *Forwarder {
+	port, listener, err := FreePort()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts.Logger = &testLogger{}
+	fw, err := startForward(context.Background(), d.dial, opts.withDefaults(), port, listener)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return fw
+}
+
+func TestRunPortForwardReconnect(t *testing.T) {
+	d := &fakeDialer{}
+	disconnects := make(chan error, 2)
+	fw := startTestPortForward(t, d, SetupOptions{
+		Reconnect:    true,
+		OnDisconnect: func(err error) { disconnects <- err },
+	})
+	if status := fw.Status(); status.State != StateHealthy || fw.Info().PodName != "controller-1" {
+		t.Fatalf("Expected a healthy forward to controller-1, got %v to %v", status, fw.Info().PodName)
+	}
+
+	// losing the connection reconnects, to whichever pod is picked
+	block := make(chan struct{})
+	d.setBlock(block)
+	d.conn(1).Close()
+	waitFor(t, "the forward to reconnect", func() bool {
+		return fw.Status().State == StateReconnecting
+	})
+	close(block)
+	waitFor(t, "the forward to be healthy again", func() bool {
+		return fw.Status().State == StateHealthy && fw.Info().PodName == "controller-2"
+	})
+
+	// so does Restart, closing the old connection
+	err := fw.Restart()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fw.Info().PodName != "controller-3" {
+		t.Errorf("Expected a forward to controller-3 after restarting, got %v", fw.Info().PodName)
+	}
+	waitFor(t, "the old connection to close", d.conn(2).isClosed)
+
+	select {
+	case err := <-disconnects:
+		t.Fatalf("Unexpected disconnect while reconnecting: %v", err)
+	default:
+	}
+
+	fw.Stop()
+	if status := fw.Status(); status.State != StateStopped || status.Err != nil {
+		t.Errorf("Expected the forward to be stopped cleanly, got %v", status)
+	}
+	if err := <-disconnects; err != nil {
+		t.Errorf("Expected no error for a stopped forward, got %v", err)
+	}
+	select {
+	case err := <-disconnects:
+		t.Errorf("Expected one disconnect, got another: %v", err)
+	default:
+	}
+}
+
+func TestStartWorkloadReconnect(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "controller", Namespace: "fission"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"application": "fission-api"}},
+		},
+	}
+	oldPod := makeTestPod("fission", "controller-5d8f9-x2k4p")
+	oldPod.Labels["pod-template-hash"] = "5d8f9"
+	clientset := fake.NewSimpleClientset(deployment, oldPod)
+
+	u := &fakeUpgrader{}
+	fw, err := StartWithClient(context.Background(), &rest.Config{}, clientset, SetupOptions{
+		Namespace:    "fission",
+		WorkloadKind: "deployment",
+		WorkloadName: "controller",
+		RemotePort:   8888,
+		Reconnect:    true,
+		Logger:       &testLogger{},
+		upgrade:      u.upgrade,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fw.Stop()
+	if fw.Info().PodName != oldPod.Name {
+		t.Fatalf("Expected a forward to %v, got %v", oldPod.Name, fw.Info().PodName)
+	}
+
+	// a rollout replaces the pod with one of a new ReplicaSet
+	newPod := makeTestPod("fission", "controller-7c6b4-m9q2z")
+	newPod.Labels["pod-template-hash"] = "7c6b4"
+	_, err = clientset.CoreV1().Pods("fission").Create(newPod)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = clientset.CoreV1().Pods("fission").Delete(oldPod.Name, &metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	u.conn(1).Close()
+	waitFor(t, "the forward to reconnect to the new pod", func() bool {
+		return fw.Status().State == StateHealthy && fw.Info().PodName == newPod.Name
+	})
+}
+
+func TestStartWithClientConcurrent(t *testing.T) {
+	// with only two ports to pick from, two forwards set up at once
+	// must each take one and keep it bound from picking it until
+	// they're forwarding
+	low := freePortPair(t)
+	clientset := fake.NewSimpleClientset(makeTestPod("fission", "controller-1"))
+	u := &fakeUpgrader{upgrading: make(chan struct{}, 2), block: make(chan struct{})}
+	opts := SetupOptions{
+		LabelSelector: testSelector,
+		RemotePort:    8888,
+		PortRange:     PortRange{Low: low, High: low + 1},
+		Logger:        &testLogger{},
+		upgrade:       u.upgrade,
+	}
+
+	type result struct {
+		fw  *Forwarder
+		err error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			fw, err := StartWithClient(context.Background(), &rest.Config{}, clientset, opts)
+			results <- result{fw, err}
+		}()
+	}
+
+	<-u.upgrading
+	<-u.upgrading
+	for _, port := range []int{low, low + 1} {
+		if err := checkPortFree(defaultBindAddress, port); err == nil {
+			t.Errorf("Expected port %v to be held while connecting to the pod", port)
+		}
+	}
+	close(u.block)
+
+	var fws []*Forwarder
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("Unexpected error: %v", r.err)
+		}
+		defer r.fw.Stop()
+		fws = append(fws, r.fw)
+	}
+	if fws[0].LocalPort == fws[1].LocalPort {
+		t.Errorf("Expected different ports, got %v twice", fws[0].LocalPort)
+	}
+	for _, fw := range fws {
+		<-fw.Ready()
+		if err := checkPortFree(defaultBindAddress, fw.LocalPort); err == nil {
+			t.Errorf("Expected port %v to be bound once ready", fw.LocalPort)
+		}
+		conn, err := net.Dial("tcp", fw.hostPort())
+		if err != nil {
+			t.Errorf("Expected port %v to accept connections, got %v", fw.LocalPort, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestRunPortForwardLost(t *testing.T) {
+	d := &fakeDialer{}
+	disconnects := make(chan error, 2)
+	fw := startTestPortForward(t, d, SetupOptions{
+		OnDisconnect: func(err error) { disconnects <- err },
+	})
+
+	// without Reconnect, losing the connection ends the forward
+	d.conn(1).Close()
+	err := fw.Wait()
+	if _, ok := err.(*ForwardError); !ok {
+		t.Fatalf("Expected a ForwardError, got %v", err)
+	}
+	if status := fw.Status(); status.State != StateStopped || status.Err != err {
+		t.Errorf("Expected the forward to be stopped with %v, got %v", err, status)
+	}
+	if disconnectErr := <-disconnects; disconnectErr != err {
+		t.Errorf("Expected OnDisconnect with %v, got %v", err, disconnectErr)
+	}
+	if d.dials() != 1 {
+		t.Errorf("Expected no reconnect, got %v dials", d.dials())
+	}
+	select {
+	case err := <-disconnects:
+		t.Errorf("Expected one disconnect, got another: %v", err)
+	default:
+	}
+}
+
+func TestRunPortForwardKeepalive(t *testing.T) {
+	// the first connection fails its keepalive probe; without
+	// Reconnect, the forward still restarts rather than failing
+	d := &fakeDialer{brokenFirst: true}
+	fw := startTestPortForward(t, d, SetupOptions{Keepalive: 10 * time.Millisecond})
+	defer fw.Stop()
+
+	waitFor(t, "the forward to restart", func() bool {
+		return fw.Info().PodName == "controller-2"
+	})
+	waitFor(t, "the broken connection to close", d.conn(1).isClosed)
+	if status := fw.Status(); status.State != StateHealthy {
+		t.Errorf("Expected a healthy forward after restarting, got %v", status)
+	}
+	select {
+	case <-fw.Done():
+		t.Errorf("Expected the forward to keep running, got %v", fw.Wait())
+	default:
+	}
+}
+
+func TestRunPortForwardMaxLifetime(t *testing.T) {
+	d := &fakeDialer{holdData: true}
+	fw := startTestPortForward(t, d, SetupOptions{MaxLifetime: 50 * time.Millisecond})
+	defer fw.Stop()
+
+	// a request in flight over the first connection
+	local, err := fw.DialContext(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatalf("Error dialing the forward: %v", err)
+	}
+	defer local.Close()
+	first := d.conn(1)
+	waitFor(t, "the request to reach the pod", func() bool {
+		return atomic.LoadInt32(&first.dataStreams) > 0
+	})
+
+	// new connections move on, while the request keeps the old one
+	waitFor(t, "the forward to restart", func() bool {
+		return d.dials() >= 3
+	})
+	if first.isClosed() {
+		t.Fatalf("Expected the connection with a request in flight to stay open")
+	}
+	if status := fw.Status(); status.State != StateHealthy {
+		t.Errorf("Expected a healthy forward, got %v", status)
+	}
+
+	// and is closed once the request is done
+	local.Close()
+	waitFor(t, "the old connection to close", first.isClosed)
+	select {
+	case <-fw.Done():
+		t.Errorf("Expected the forward to keep running, got %v", fw.Wait())
+	default:
+	}
+}
+
+func TestRunWithPort(t *testing.T) {
+	err := runWithPort(context.Background(), "FISSION_PORT", []string{"sh", "-c", `test "$FISSION_PORT" = 1234`}, 1234)
+	if err != nil {
+		t.Errorf("Expected the port in the command's environment, got %v", err)
+	}
+	err = runWithPort(context.Background(), "FISSION_PORT", []string{"sh", "-c", "exit 1"}, 1234)
+	if err == nil {
+		t.Errorf("Expected an error from a failing command")
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDialErrorKind(t *testing.T) {
+	// nothing listens on a port that was just freed
+	port, err := findFreePort(defaultBindAddress, PortRange{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, refused := net.Dial("tcp", net.JoinHostPort(defaultBindAddress, strconv.Itoa(port)))
+	if refused == nil {
+		t.Fatalf("Expected dialing a free port to fail")
+	}
+
+	tests := []struct {
+		err    error
+		expect string
+	}{
+		{refused, "connection refused"},
+		{errors.Wrap(refused, "Probe failed"), "connection refused"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, "connection reset"},
+		{timeoutError{}, "timed out"},
+		{errors.New("HTTP 503"), "failed"},
+	}
+	for _, test := range tests {
+		if kind := dialErrorKind(test.err); kind != test.expect {
+			t.Errorf("%v: expected %q, got %q", test.err, test.expect, kind)
+		}
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	err := func() (err error) {
+		defer recoverPanic(&err)
+		panic("malformed frame")
+	}()
+	if err == nil || !strings.Contains(err.Error(), "malformed frame") {
+		t.Fatalf("Expected an error for the panic, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "TestRecoverPanic") {
+		t.Errorf("Expected the stack in the error, got %v", err)
+	}
+}
@@ -0,0 +1,951 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// target is the pod, and the port on it, that a forward connects to.
+type target struct {
+	pod         *apiv1.Pod
+	service     *apiv1.Service
+	servicePort *apiv1.ServicePort
+	remotePort  int
+
+	// candidates are the ready pods pod was picked from
+	candidates []apiv1.Pod
+}
+
+// ServiceRef identifies the service port a forward goes through, and the
+// port on the pod it's forwarded to.
+type ServiceRef struct {
+	Namespace  string
+	Name       string
+	Port       int
+	TargetPort int
+}
+
+// Resolve does the lookups Setup does for the pod matching
+// labelSelector in namespace, without forwarding anything, e.g. to
+// preview what a forward would connect to. It returns the ready pods
+// one would be picked from, and the service port and target port that
+// would be used. Like Setup, it fails with a *MultipleInstallsError if
+// the pods are in more than one namespace.
+func Resolve(kubeConfig, namespace, labelSelector string) ([]PodRef, *ServiceRef, error) {
+	opts := SetupOptions{
+		KubeConfig:    kubeConfig,
+		Namespace:     namespace,
+		LabelSelector: labelSelector,
+	}.withDefaults()
+	_, clientset, err := connect(opts)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to connect to Kubernetes")
+	}
+	return resolve(clientset, opts)
+}
+
+// resolve does the work of Resolve with the given clientset.
+func resolve(clientset kubernetes.Interface, opts SetupOptions) ([]PodRef, *ServiceRef, error) {
+	t, err := resolveTarget(clientset, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var service *ServiceRef
+	if t.service != nil {
+		service = &ServiceRef{
+			Namespace:  t.service.Namespace,
+			Name:       t.service.Name,
+			Port:       int(t.servicePort.Port),
+			TargetPort: t.remotePort,
+		}
+	}
+	return podRefs(t.candidates), service, nil
+}
+
+// resolveTarget finds the pod matching opts and the service port to
+// forward to on it.
+func resolveTarget(clientset kubernetes.Interface, opts SetupOptions) (*target, error) {
+	t, err := findTarget(clientset, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Container) > 0 {
+		err = checkContainerPort(t.pod, opts.Container, t.remotePort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// findTarget does the work of resolveTarget, except for checking the
+// target port against opts.Container.
+func findTarget(clientset kubernetes.Interface, opts SetupOptions) (*target, error) {
+	if len(opts.LabelSelectors) > 0 {
+		return resolveAnySelector(clientset, opts)
+	}
+	if len(opts.LabelSelector) == 0 && len(opts.PodName) > 0 {
+		return resolvePod(clientset, opts)
+	}
+	if opts.UseEndpoints {
+		return resolveEndpoints(clientset, opts)
+	}
+
+	labelSelector, ns := opts.LabelSelector, opts.Namespace
+
+	// the API server's errors for bad selectors are hard to make sense of
+	_, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Invalid label selector %q", labelSelector))
+	}
+
+	// if namespace is unset, try to find a pod in any namespace
+	if len(ns) == 0 {
+		ns = meta_v1.NamespaceAll
+	}
+
+	// get the pod; if there is more than one, ask the user to disambiguate
+	var podList *apiv1.PodList
+	err = retryAPI(opts, func() error {
+		var err error
+		podList, err = clientset.CoreV1().Pods(ns).List(podListOptions(opts, labelSelector))
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting controller pod for port-forwarding")
+	}
+	if len(podList.Items) == 0 {
+		return nil, errors.Wrap(ErrNoPods, fmt.Sprintf("Error getting pods matching %v", labelSelector))
+	}
+
+	// skip pods that are starting up or shutting down
+	pods := readyPods(podList.Items)
+	if len(pods) == 0 {
+		return nil, errors.Wrap(ErrNoReadyPods, fmt.Sprintf("None of the %v pods matching %v are ready", len(podList.Items), labelSelector))
+	}
+
+	if len(opts.PodName) > 0 {
+		pods = podsNamed(pods, opts.PodName)
+		if len(pods) == 0 {
+			return nil, errors.Wrap(ErrNoReadyPods, fmt.Sprintf("No ready pod %v matches %v", opts.PodName, labelSelector))
+		}
+	}
+
+	if len(opts.skipPods) > 0 {
+		pods = podsExcept(pods, opts.skipPods)
+		if len(pods) == 0 {
+			return nil, errors.Wrap(ErrNoReadyPods, fmt.Sprintf("None of the ready pods matching %v are left to try", labelSelector))
+		}
+	}
+
+	// with more than one install, let the caller pick or make a
+	// useful error message, unless the caller is fine with any of them
+	var pod *apiv1.Pod
+	namespaces := podNamespaces(pods)
+	if len(namespaces) > 1 && (opts.SelectPod != nil || !opts.AllowMultiple) {
+		installsErr := &MultipleInstallsError{
+			LabelSelector: labelSelector,
+			Namespaces:    namespaces,
+			Pods:          podRefs(pods),
+		}
+		if opts.SelectPod == nil {
+			return nil, installsErr
+		}
+		ref, err := opts.SelectPod(installsErr.Pods)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error selecting a pod")
+		}
+		pod = findPod(pods, ref)
+		if pod == nil {
+			return nil, errors.New(fmt.Sprintf("Selected pod %v isn't one of the candidates", ref))
+		}
+	} else {
+		pod, err = pickPod(pods, opts.Strategy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// an explicit port means there's no need for the service
+	if opts.RemotePort != 0 {
+		return &target{
+			pod:        pod,
+			remotePort: opts.RemotePort,
+			candidates: pods,
+		}, nil
+	}
+
+	// get the service and the target port
+	var service *apiv1.Service
+	err = retryAPI(opts, func() error {
+		var err error
+		service, err = waitForService(clientset, opts, pod.Namespace, labelSelector)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	servicePort, err := findServicePort(service, opts.PortName)
+	if err != nil {
+		return nil, err
+	}
+	// an empty protocol defaults to TCP
+	if len(servicePort.Protocol) > 0 && servicePort.Protocol != apiv1.ProtocolTCP {
+		return nil, errors.Wrap(ErrUnsupportedProtocol, fmt.Sprintf("Port %v on service %v is %v",
+			servicePortName(servicePort), service.Name, servicePort.Protocol))
+	}
+	remotePort, err := findTargetPort(pod, service, servicePort, opts.Container)
+	if err != nil {
+		return nil, err
+	}
+
+	return &target{
+		pod:         pod,
+		service:     service,
+		servicePort: servicePort,
+		remotePort:  remotePort,
+		candidates:  pods,
+	}, nil
+}
+
+// resolveAnySelector tries opts.LabelSelector and then each of
+// opts.LabelSelectors in turn, returning the target for the first one
+// that resolves.
+func resolveAnySelector(clientset kubernetes.Interface, opts SetupOptions) (*target, error) {
+	selectors := opts.LabelSelectors
+	if len(opts.LabelSelector) > 0 {
+		selectors = append([]string{opts.LabelSelector}, selectors...)
+	}
+
+	selectorsErr := &SelectorsError{}
+	for _, selector := range selectors {
+		selectorOpts := opts
+		selectorOpts.LabelSelector = selector
+		selectorOpts.LabelSelectors = nil
+
+		t, err := resolveTarget(clientset, selectorOpts)
+		if err == nil {
+			return t, nil
+		}
+		opts.logger().Verbose(2, "No target for selector %v: %v", selector, err)
+		selectorsErr.Selectors = append(selectorsErr.Selectors, selector)
+		selectorsErr.Errors = append(selectorsErr.Errors, err)
+	}
+	return nil, selectorsErr
+}
+
+// workloadSelector returns the label selector for the pods of the
+// Deployment or StatefulSet called name in namespace.
+func workloadSelector(clientset kubernetes.Interface, opts SetupOptions, namespace, kind, name string) (string, error) {
+	var selector *meta_v1.LabelSelector
+	var err error
+	switch strings.ToLower(kind) {
+	case "deployment", "deployments", "deploy":
+		err = retryAPI(opts, func() error {
+			deployment, err := clientset.AppsV1().Deployments(namespace).Get(name, meta_v1.GetOptions{})
+			if err == nil {
+				selector = deployment.Spec.Selector
+			}
+			return err
+		})
+	case "statefulset", "statefulsets", "sts":
+		err = retryAPI(opts, func() error {
+			statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(name, meta_v1.GetOptions{})
+			if err == nil {
+				selector = statefulSet.Spec.Selector
+			}
+			return err
+		})
+	default:
+		return "", errors.New(fmt.Sprintf("Unsupported kind %v, only Deployments and StatefulSets can be forwarded to", kind))
+	}
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("Error getting %v %v/%v", kind, namespace, name))
+	}
+
+	labelSelector, err := meta_v1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("Invalid selector on %v %v/%v", kind, namespace, name))
+	}
+	if labelSelector.Empty() {
+		return "", errors.New(fmt.Sprintf("%v %v/%v has no selector", kind, namespace, name))
+	}
+	return labelSelector.String(), nil
+}
+
+// WaitForService looks for a service matching labelSelector in
+// namespace, trying up to attempts times with interval in between. It
+// fails with ErrServiceNotFound if there's still none after the last
+// attempt, or with a *MultipleServicesError if there's more than one.
+func WaitForService(clientset kubernetes.Interface, namespace, labelSelector string, attempts int, interval time.Duration) (*apiv1.Service, error) {
+	return waitForService(clientset, SetupOptions{
+		ServiceAttempts:      attempts,
+		ServiceRetryInterval: interval,
+	}, namespace, labelSelector)
+}
+
+// waitForService is WaitForService with the attempts, interval and
+// logger from opts. With opts.ServiceName, only the service with that
+// name counts.
+func waitForService(clientset kubernetes.Interface, opts SetupOptions, namespace, labelSelector string) (*apiv1.Service, error) {
+	attempts, interval := opts.ServiceAttempts, opts.ServiceRetryInterval
+	for i := 0; ; i++ {
+		svcs, err := clientset.CoreV1().Services(namespace).
+			List(meta_v1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Error getting %v service", labelSelector))
+		}
+		services := svcs.Items
+		if len(opts.ServiceName) > 0 {
+			services = servicesNamed(services, opts.ServiceName)
+		}
+		if len(services) > 1 {
+			names := make([]string, 0, len(services))
+			for _, service := range services {
+				names = append(names, service.Name)
+			}
+			return nil, &MultipleServicesError{
+				LabelSelector: labelSelector,
+				Namespace:     namespace,
+				Names:         names,
+			}
+		}
+		if len(services) == 1 {
+			return &services[0], nil
+		}
+		if i+1 >= attempts {
+			return nil, errors.Wrap(ErrServiceNotFound, fmt.Sprintf("Error getting %v service", labelSelector))
+		}
+		opts.logger().Verbose(2, "No %v service in %v yet, retrying in %v", labelSelector, namespace, interval)
+		time.Sleep(interval)
+	}
+}
+
+// resolveEndpoints finds the service matching opts.LabelSelector and
+// picks the first ready address in its Endpoints that backs the service
+// port, skipping opts.skipPods and, with opts.PodName, other pods.
+func resolveEndpoints(clientset kubernetes.Interface, opts SetupOptions) (*target, error) {
+	labelSelector, ns := opts.LabelSelector, opts.Namespace
+	_, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Invalid label selector %q", labelSelector))
+	}
+	if len(ns) == 0 {
+		ns = meta_v1.NamespaceAll
+	}
+
+	var service *apiv1.Service
+	err = retryAPI(opts, func() error {
+		var err error
+		service, err = waitForService(clientset, opts, ns, labelSelector)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	servicePort, err := findServicePort(service, opts.PortName)
+	if err != nil {
+		return nil, err
+	}
+	if len(servicePort.Protocol) > 0 && servicePort.Protocol != apiv1.ProtocolTCP {
+		return nil, errors.Wrap(ErrUnsupportedProtocol, fmt.Sprintf("Port %v on service %v is %v",
+			servicePortName(servicePort), service.Name, servicePort.Protocol))
+	}
+
+	var endpoints *apiv1.Endpoints
+	err = retryAPI(opts, func() error {
+		var err error
+		endpoints, err = clientset.CoreV1().Endpoints(service.Namespace).Get(service.Name, meta_v1.GetOptions{})
+		return err
+	})
+	if k8serrors.IsNotFound(err) {
+		return nil, errors.Wrap(ErrNoPods, fmt.Sprintf("Service %v/%v has no endpoints", service.Namespace, service.Name))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error getting endpoints of service %v/%v", service.Namespace, service.Name))
+	}
+
+	// the endpoint ports are named after the service ports
+	for _, subset := range endpoints.Subsets {
+		remotePort := 0
+		for _, port := range subset.Ports {
+			if port.Name == servicePort.Name && port.Port > 0 {
+				remotePort = int(port.Port)
+			}
+		}
+		if remotePort == 0 {
+			continue
+		}
+		for _, address := range subset.Addresses {
+			ref := address.TargetRef
+			if ref == nil || ref.Kind != "Pod" {
+				continue
+			}
+			if len(opts.PodName) > 0 && ref.Name != opts.PodName {
+				continue
+			}
+			podRef := PodRef{Namespace: service.Namespace, Name: ref.Name}
+			if hasRef(opts.skipPods, podRef.Namespace, podRef.Name) {
+				continue
+			}
+
+			var pod *apiv1.Pod
+			err = retryAPI(opts, func() error {
+				var err error
+				pod, err = clientset.CoreV1().Pods(podRef.Namespace).Get(podRef.Name, meta_v1.GetOptions{})
+				return err
+			})
+			if k8serrors.IsNotFound(err) {
+				// the endpoints lag behind pods going away
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("Error getting pod %v behind service %v", podRef, service.Name))
+			}
+			return &target{
+				pod:         pod,
+				service:     service,
+				servicePort: servicePort,
+				remotePort:  remotePort,
+				candidates:  []apiv1.Pod{*pod},
+			}, nil
+		}
+	}
+	return nil, errors.Wrap(ErrNoReadyPods, fmt.Sprintf("No ready endpoint for port %v of service %v/%v",
+		servicePortName(servicePort), service.Namespace, service.Name))
+}
+
+// resolvePod looks up the pod named opts.PodName directly, for
+// forwarding to opts.RemotePort on it without going through a service.
+func resolvePod(clientset kubernetes.Interface, opts SetupOptions) (*target, error) {
+	ns := opts.Namespace
+	if len(ns) == 0 {
+		ns = meta_v1.NamespaceDefault
+	}
+	if opts.RemotePort == 0 {
+		return nil, errors.Wrap(ErrPortNotFound, fmt.Sprintf("No port given to forward to on pod %v/%v", ns, opts.PodName))
+	}
+
+	var pod *apiv1.Pod
+	err := retryAPI(opts, func() error {
+		var err error
+		pod, err = clientset.CoreV1().Pods(ns).Get(opts.PodName, meta_v1.GetOptions{})
+		return err
+	})
+	if k8serrors.IsNotFound(err) {
+		return nil, errors.Wrap(ErrNoPods, fmt.Sprintf("Pod %v/%v not found", ns, opts.PodName))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error getting pod %v/%v", ns, opts.PodName))
+	}
+	if pod.Status.Phase != apiv1.PodRunning {
+		return nil, errors.Wrap(ErrNoReadyPods, fmt.Sprintf("Pod %v/%v is %v, not running", ns, opts.PodName, pod.Status.Phase))
+	}
+
+	return &target{
+		pod:        pod,
+		remotePort: opts.RemotePort,
+		candidates: []apiv1.Pod{*pod},
+	}, nil
+}
+
+// findTargetPort returns the numeric container port on pod that
+// servicePort targets. Named target ports are looked up in the pod's
+// container specs, or just containerName's if it's set, since the port
+// forward needs a number.
+func findTargetPort(pod *apiv1.Pod, service *apiv1.Service, servicePort *apiv1.ServicePort, containerName string) (int, error) {
+	targetPort := servicePort.TargetPort
+	if targetPort.Type == intstr.Int {
+		port := targetPort.IntVal
+		if port == 0 {
+			// unset, so the service forwards to the same port
+			port = servicePort.Port
+		}
+		if port <= 0 {
+			return 0, errors.Wrap(ErrPortNotFound, fmt.Sprintf("Port %v on service %v has no port number to forward to",
+				servicePortName(servicePort), service.Name))
+		}
+		return int(port), nil
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if len(containerName) > 0 && container.Name != containerName {
+			continue
+		}
+		for _, port := range container.Ports {
+			// a malformed pod may declare a named port without a number
+			if len(port.Name) > 0 && port.Name == targetPort.StrVal && port.ContainerPort > 0 {
+				return int(port.ContainerPort), nil
+			}
+		}
+	}
+	return 0, errors.Wrap(ErrPortNotFound, fmt.Sprintf("Invalid target port %v on service %v: no container port with that name on pod %v/%v",
+		targetPort.StrVal, service.Name, pod.Namespace, pod.Name))
+}
+
+// servicesNamed returns the services in services called name.
+func servicesNamed(services []apiv1.Service, name string) []apiv1.Service {
+	named := make([]apiv1.Service, 0, 1)
+	for _, service := range services {
+		if service.Name == name {
+			named = append(named, service)
+		}
+	}
+	return named
+}
+
+// checkNode warns if the node pod is on isn't ready, since connecting
+// to the pod then hangs rather than failing; with
+// opts.RequireReadyNode it fails instead. Errors getting the node, e.g.
+// for lack of permission, are only logged.
+func checkNode(clientset kubernetes.Interface, opts SetupOptions, pod *apiv1.Pod) error {
+	if len(pod.Spec.NodeName) == 0 {
+		return nil
+	}
+	node, err := clientset.CoreV1().Nodes().Get(pod.Spec.NodeName, meta_v1.GetOptions{})
+	if err != nil {
+		opts.logger().Verbose(2, "Couldn't check node %v of pod %v/%v: %v", pod.Spec.NodeName, pod.Namespace, pod.Name, err)
+		return nil
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != apiv1.NodeReady || condition.Status == apiv1.ConditionTrue {
+			continue
+		}
+		msg := fmt.Sprintf("Node %v of pod %v/%v isn't ready (%v), so it's probably unreachable",
+			node.Name, pod.Namespace, pod.Name, condition.Reason)
+		if opts.RequireReadyNode {
+			return errors.New(msg)
+		}
+		opts.logger().Warn(msg)
+	}
+	return nil
+}
+
+// checkContainerPort checks that the container called containerName on
+// pod declares port.
+func checkContainerPort(pod *apiv1.Pod, containerName string, port int) error {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != containerName {
+			continue
+		}
+		for _, containerPort := range container.Ports {
+			if int(containerPort.ContainerPort) == port {
+				return nil
+			}
+		}
+		return errors.Wrap(ErrPortNotFound, fmt.Sprintf("Container %v on pod %v/%v doesn't expose port %v",
+			containerName, pod.Namespace, pod.Name, port))
+	}
+	return errors.Wrap(ErrPortNotFound, fmt.Sprintf("Pod %v/%v has no container %v", pod.Namespace, pod.Name, containerName))
+}
+
+// waitForReadyPod waits up to opts.WaitForPod for a pod matching opts to
+// be ready, or until stopChannel is closed. It watches the pods, or if
+// that isn't allowed, or there are several selectors, lists them about
+// every containerPollInterval instead.
+func waitForReadyPod(clientset kubernetes.Interface, opts SetupOptions, stopChannel <-chan struct{}) error {
+	timeout := time.After(opts.WaitForPod)
+	selectors := opts.LabelSelectors
+	if len(opts.LabelSelector) > 0 {
+		selectors = append([]string{opts.LabelSelector}, selectors...)
+	}
+	timeoutErr := errors.Wrap(ErrNoReadyPods, fmt.Sprintf("Timed out after %v waiting for a pod matching %v to be ready",
+		opts.WaitForPod, strings.Join(selectors, " or ")))
+	if len(opts.LabelSelectors) > 0 {
+		return pollForReadyPod(clientset, opts, timeout, timeoutErr, stopChannel)
+	}
+
+	// a pod picked by name alone is looked for where resolvePod looks
+	ns := opts.Namespace
+	if len(ns) == 0 && len(opts.LabelSelector) == 0 && len(opts.PodName) > 0 {
+		ns = meta_v1.NamespaceDefault
+		timeoutErr = errors.Wrap(ErrNoReadyPods, fmt.Sprintf("Timed out after %v waiting for pod %v/%v to be ready",
+			opts.WaitForPod, ns, opts.PodName))
+	} else if len(ns) == 0 {
+		ns = meta_v1.NamespaceAll
+	}
+	for {
+		// A watch without a resource version starts with the pods that
+		// already exist, so there's no missing one getting ready since
+		// they were last listed.
+		w, err := clientset.CoreV1().Pods(ns).Watch(meta_v1.ListOptions{
+			LabelSelector: opts.LabelSelector,
+			FieldSelector: opts.FieldSelector,
+		})
+		if k8serrors.IsForbidden(err) {
+			opts.logger().Verbose(2, "Not allowed to watch pods, polling instead: %v", err)
+			return pollForReadyPod(clientset, opts, timeout, timeoutErr, stopChannel)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Error watching pods")
+		}
+
+		ready, err := watchForReadyPod(w, opts.PodName, timeout, timeoutErr, stopChannel)
+		w.Stop()
+		if ready || err != nil {
+			return err
+		}
+		// the API server ended the watch; start another one
+	}
+}
+
+// watchForReadyPod waits for w to report a ready pod, called podName if
+// that's set. It returns false if the watch ends first.
+func watchForReadyPod(w watch.Interface, podName string, timeout <-chan time.Time, timeoutErr error,
+	stopChannel <-chan struct{}) (bool, error) {
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			pod, ok := event.Object.(*apiv1.Pod)
+			if !ok || event.Type == watch.Deleted || (len(podName) > 0 && pod.Name != podName) {
+				continue
+			}
+			if len(readyPods([]apiv1.Pod{*pod})) > 0 {
+				return true, nil
+			}
+		case <-timeout:
+			return false, timeoutErr
+		case <-stopChannel:
+			return false, errors.New("Stopped waiting for a ready pod")
+		}
+	}
+}
+
+// pollForReadyPod waits for a pod matching opts to be ready by looking
+// for one every so often.
+func pollForReadyPod(clientset kubernetes.Interface, opts SetupOptions, timeout <-chan time.Time, timeoutErr error,
+	stopChannel <-chan struct{}) error {
+	backoff := makePollBackoff(containerPollInterval)
+	for {
+		// any other error is for the caller to find on resolving again
+		_, err := findTarget(clientset, opts)
+		if !noPodsYet(err) {
+			return nil
+		}
+
+		select {
+		case <-time.After(backoff.next()):
+		case <-timeout:
+			return timeoutErr
+		case <-stopChannel:
+			return errors.New("Stopped waiting for a ready pod")
+		}
+	}
+}
+
+// noPodsYet says whether err means there's no ready pod to forward to
+// yet, which with several label selectors means that's so for each one.
+func noPodsYet(err error) bool {
+	cause := errors.Cause(err)
+	if selectorsErr, ok := cause.(*SelectorsError); ok {
+		for _, err := range selectorsErr.Errors {
+			if !noPodsYet(err) {
+				return false
+			}
+		}
+		return len(selectorsErr.Errors) > 0
+	}
+	return cause == ErrNoPods || cause == ErrNoReadyPods
+}
+
+// waitForContainer waits until the container serving t.remotePort on
+// t.pod is ready, re-reading the pod about every containerPollInterval,
+// or stopChannel is closed.
+func waitForContainer(clientset kubernetes.Interface, opts SetupOptions, t *target, stopChannel <-chan struct{}) error {
+	pod := t.pod
+	backoff := makePollBackoff(containerPollInterval)
+	for {
+		if containerReady(pod, t.remotePort, opts.Container) {
+			return nil
+		}
+		opts.logger().Verbose(2, "Waiting for the container serving port %v on pod %v/%v to be ready",
+			t.remotePort, pod.Namespace, pod.Name)
+
+		select {
+		case <-stopChannel:
+			return errors.New(fmt.Sprintf("Stopped waiting for pod %v/%v to be ready", pod.Namespace, pod.Name))
+		case <-time.After(backoff.next()):
+		}
+
+		err := retryAPI(opts, func() error {
+			var err error
+			pod, err = clientset.CoreV1().Pods(t.pod.Namespace).Get(t.pod.Name, meta_v1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Error getting pod %v/%v", t.pod.Namespace, t.pod.Name))
+		}
+		if pod.DeletionTimestamp != nil {
+			return errors.Wrap(ErrNoReadyPods, fmt.Sprintf("Pod %v/%v is shutting down", pod.Namespace, pod.Name))
+		}
+	}
+}
+
+// containerReady says whether the container declaring port on pod is
+// ready, or if none declares it, whether all of them are. If
+// containerName is set, it's the container that must be ready.
+func containerReady(pod *apiv1.Pod, port int, containerName string) bool {
+	names := make(map[string]bool)
+	if len(containerName) > 0 {
+		names[containerName] = true
+	} else {
+		for _, container := range pod.Spec.Containers {
+			for _, containerPort := range container.Ports {
+				if int(containerPort.ContainerPort) == port {
+					names[container.Name] = true
+				}
+			}
+		}
+	}
+
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return false
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if (len(names) == 0 || names[status.Name]) && !status.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// PodRef identifies a candidate pod to forward to.
+type PodRef struct {
+	Namespace    string
+	Name         string
+	CreationTime time.Time
+}
+
+func (ref PodRef) String() string {
+	return ref.Namespace + "/" + ref.Name
+}
+
+// podRefs returns refs to pods, in order.
+func podRefs(pods []apiv1.Pod) []PodRef {
+	refs := make([]PodRef, 0, len(pods))
+	for _, pod := range pods {
+		refs = append(refs, PodRef{
+			Namespace:    pod.Namespace,
+			Name:         pod.Name,
+			CreationTime: pod.CreationTimestamp.Time,
+		})
+	}
+	return refs
+}
+
+// findPod returns the pod in pods that ref refers to, or nil.
+func findPod(pods []apiv1.Pod, ref PodRef) *apiv1.Pod {
+	for i := range pods {
+		if pods[i].Namespace == ref.Namespace && pods[i].Name == ref.Name {
+			return &pods[i]
+		}
+	}
+	return nil
+}
+
+// podsExcept returns the pods in pods that refs don't refer to.
+func podsExcept(pods []apiv1.Pod, refs []PodRef) []apiv1.Pod {
+	except := make([]apiv1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if !hasRef(refs, pod.Namespace, pod.Name) {
+			except = append(except, pod)
+		}
+	}
+	return except
+}
+
+// hasRef returns whether refs includes the pod namespace/name.
+func hasRef(refs []PodRef, namespace, name string) bool {
+	for _, ref := range refs {
+		if ref.Namespace == namespace && ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// podListOptions returns the options for listing the pods matching
+// labelSelector. With opts.PodListLimit, the API server also skips
+// pods that aren't running, so they don't use up the limit; otherwise
+// they're listed so that ErrNoReadyPods can be told from ErrNoPods.
+func podListOptions(opts SetupOptions, labelSelector string) meta_v1.ListOptions {
+	listOptions := meta_v1.ListOptions{
+		LabelSelector: labelSelector,
+		FieldSelector: opts.FieldSelector,
+	}
+	if opts.PodListLimit > 0 {
+		listOptions.Limit = opts.PodListLimit
+		running := "status.phase=" + string(apiv1.PodRunning)
+		if len(listOptions.FieldSelector) > 0 {
+			running = listOptions.FieldSelector + "," + running
+		}
+		listOptions.FieldSelector = running
+	}
+	return listOptions
+}
+
+// readyPods returns the pods that are running, ready and not being
+// deleted.
+func readyPods(pods []apiv1.Pod) []apiv1.Pod {
+	ready := make([]apiv1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != apiv1.PodRunning {
+			continue
+		}
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == apiv1.PodReady && cond.Status == apiv1.ConditionTrue {
+				ready = append(ready, pod)
+				break
+			}
+		}
+	}
+	return ready
+}
+
+// podNamespaces returns the distinct namespaces of pods, in order.
+func podNamespaces(pods []apiv1.Pod) []string {
+	namespaces := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pod := range pods {
+		if !seen[pod.Namespace] {
+			seen[pod.Namespace] = true
+			namespaces = append(namespaces, pod.Namespace)
+		}
+	}
+	return namespaces
+}
+
+// podsNamed returns the pods called name.
+func podsNamed(pods []apiv1.Pod, name string) []apiv1.Pod {
+	named := make([]apiv1.Pod, 0, 1)
+	for _, pod := range pods {
+		if pod.Name == name {
+			named = append(named, pod)
+		}
+	}
+	return named
+}
+
+// random picks pods for PickRandom and makes forward IDs. It's seeded
+// per process, unlike math/rand's global source, so separate runs don't
+// all pick the same pod or log the same IDs.
+var (
+	randomLock sync.Mutex
+	random     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// randomIntn is random.Intn, safe to call concurrently.
+func randomIntn(n int) int {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return random.Intn(n)
+}
+
+// pickPod returns the pod strategy picks out of pods.
+func pickPod(pods []apiv1.Pod, strategy PodSelectStrategy) (*apiv1.Pod, error) {
+	switch strategy {
+	case "", PickNewest:
+		return newestPod(pods), nil
+	case PickOldest:
+		return oldestPod(pods), nil
+	case PickFirst:
+		return &pods[0], nil
+	case PickRandom:
+		return &pods[randomIntn(len(pods))], nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown pod select strategy %q", strategy))
+}
+
+// newestPod returns the most recently created of pods. Pods created at
+// the same time are ordered by name, so the same pod is picked every
+// time for the same set of pods.
+func newestPod(pods []apiv1.Pod) *apiv1.Pod {
+	newest := &pods[0]
+	for i := range pods {
+		pod := &pods[i]
+		if newest.CreationTimestamp.Before(&pod.CreationTimestamp) ||
+			(newest.CreationTimestamp.Equal(&pod.CreationTimestamp) && pod.Name < newest.Name) {
+			newest = pod
+		}
+	}
+	return newest
+}
+
+// oldestPod returns the least recently created of pods, with ties
+// broken by name like newestPod.
+func oldestPod(pods []apiv1.Pod) *apiv1.Pod {
+	oldest := &pods[0]
+	for i := range pods {
+		pod := &pods[i]
+		if pod.CreationTimestamp.Before(&oldest.CreationTimestamp) ||
+			(pod.CreationTimestamp.Equal(&oldest.CreationTimestamp) && pod.Name < oldest.Name) {
+			oldest = pod
+		}
+	}
+	return oldest
+}
+
+// servicePortName returns the name of servicePort, or its number if
+// it's unnamed.
+func servicePortName(servicePort *apiv1.ServicePort) string {
+	if len(servicePort.Name) > 0 {
+		return servicePort.Name
+	}
+	return strconv.Itoa(int(servicePort.Port))
+}
+
+// findServicePort returns the port on service named portName, or with
+// portName as its number, or the first port declared on the service if
+// portName is empty.
+func findServicePort(service *apiv1.Service, portName string) (*apiv1.ServicePort, error) {
+	if len(service.Spec.Ports) == 0 {
+		return nil, errors.Wrap(ErrPortNotFound, fmt.Sprintf("Service %v has no ports", service.Name))
+	}
+	if len(portName) == 0 {
+		return &service.Spec.Ports[0], nil
+	}
+	for i := range service.Spec.Ports {
+		if service.Spec.Ports[i].Name == portName {
+			return &service.Spec.Ports[i], nil
+		}
+	}
+	for i := range service.Spec.Ports {
+		if strconv.Itoa(int(service.Spec.Ports[i].Port)) == portName {
+			return &service.Spec.Ports[i], nil
+		}
+	}
+	return nil, errors.Wrap(ErrPortNotFound, fmt.Sprintf("Service %v has no port named %v", service.Name, portName))
+}
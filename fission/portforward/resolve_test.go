@@ -0,0 +1,1135 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testSelector = "application=fission-api"
+
+// errMultipleInstalls stands in for any *MultipleInstallsError in test
+// tables.
+var errMultipleInstalls = errors.New("multiple installs")
+
+// errMultipleServices likewise stands in for any *MultipleServicesError.
+var errMultipleServices = errors.New("multiple services")
+
+func makeTestPod(namespace, name string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"application": "fission-api"},
+		},
+		Status: apiv1.PodStatus{
+			Phase: apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{
+				{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+			},
+		},
+	}
+}
+
+func makeTestPendingPod(namespace, name string) *apiv1.Pod {
+	pod := makeTestPod(namespace, name)
+	pod.Status = apiv1.PodStatus{Phase: apiv1.PodPending}
+	return pod
+}
+
+func makeTestService(namespace string, ports ...apiv1.ServicePort) *apiv1.Service {
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "controller",
+			Namespace: namespace,
+			Labels:    map[string]string{"application": "fission-api"},
+		},
+		Spec: apiv1.ServiceSpec{
+			Ports: ports,
+		},
+	}
+}
+
+func makeTestNamedService(namespace, name string, ports ...apiv1.ServicePort) *apiv1.Service {
+	service := makeTestService(namespace, ports...)
+	service.Name = name
+	return service
+}
+
+func makeTestServicePort(name string, targetPort int) apiv1.ServicePort {
+	return apiv1.ServicePort{
+		Name:       name,
+		Port:       80,
+		TargetPort: intstr.FromInt(targetPort),
+	}
+}
+
+// makeRandomObjects returns pods and maybe a service with the shapes
+// real clusters sometimes have: no ports, unnamed and named-only ports,
+// unset target ports, non-TCP protocols and several namespaces.
+func makeRandomObjects(r *rand.Rand) []runtime.Object {
+	var objects []runtime.Object
+	namespaces := []string{"fission", "other"}[:1+r.Intn(2)]
+	for _, ns := range namespaces {
+		for i := r.Intn(4); i > 0; i-- {
+			pod := makeTestPod(ns, fmt.Sprintf("controller-%v", i))
+			if r.Intn(4) == 0 {
+				pod = makeTestPendingPod(ns, pod.Name)
+			}
+			for c := r.Intn(3); c > 0; c-- {
+				container := apiv1.Container{Name: []string{"main", "sidecar", ""}[r.Intn(3)]}
+				for p := r.Intn(3); p > 0; p-- {
+					container.Ports = append(container.Ports, apiv1.ContainerPort{
+						Name:          []string{"", "http", "metrics"}[r.Intn(3)],
+						ContainerPort: []int32{0, 8888, 9090}[r.Intn(3)],
+					})
+				}
+				pod.Spec.Containers = append(pod.Spec.Containers, container)
+			}
+			objects = append(objects, pod)
+		}
+		if r.Intn(3) == 0 {
+			continue
+		}
+		service := makeTestService(ns)
+		for p := r.Intn(3); p > 0; p-- {
+			service.Spec.Ports = append(service.Spec.Ports, apiv1.ServicePort{
+				Name:     []string{"", "http", "metrics"}[r.Intn(3)],
+				Port:     []int32{0, 80, 8080}[r.Intn(3)],
+				Protocol: []apiv1.Protocol{"", apiv1.ProtocolTCP, apiv1.ProtocolUDP}[r.Intn(3)],
+				TargetPort: []intstr.IntOrString{{}, intstr.FromInt(0), intstr.FromInt(8888),
+					intstr.FromString(""), intstr.FromString("http"), intstr.FromString("missing")}[r.Intn(6)],
+			})
+		}
+		objects = append(objects, service)
+	}
+	return objects
+}
+
+func TestResolveTargetRandomObjects(t *testing.T) {
+	const seed = 1
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < 500; i++ {
+		objects := makeRandomObjects(r)
+		opts := SetupOptions{
+			LabelSelector: testSelector,
+			PortName:      []string{"", "http", "80"}[r.Intn(3)],
+			RemotePort:    []int{0, 0, 9000}[r.Intn(3)],
+			Container:     []string{"", "main"}[r.Intn(2)],
+			AllowMultiple: r.Intn(2) == 0,
+		}
+
+		var (
+			target *target
+			err    error
+		)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("Case %v (seed %v): panicked resolving %+v with opts %+v: %v", i, seed, objects, opts, r)
+				}
+			}()
+			target, err = resolveTarget(fake.NewSimpleClientset(objects...), opts)
+		}()
+		if err != nil {
+			if !isResolveError(err) {
+				t.Errorf("Case %v (seed %v): unexpected error resolving %+v with opts %+v: %v", i, seed, objects, opts, err)
+			}
+			continue
+		}
+		if target.pod == nil || target.remotePort <= 0 || target.remotePort > 65535 {
+			t.Errorf("Case %v (seed %v): expected a pod and a valid port resolving %+v with opts %+v, got pod %v, port %v",
+				i, seed, objects, opts, target.pod, target.remotePort)
+		}
+	}
+}
+
+// isResolveError reports whether err is one of the errors resolving a
+// target is documented to fail with.
+func isResolveError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *MultipleInstallsError, *MultipleServicesError, *SelectorsError:
+		return true
+	}
+	switch errors.Cause(err) {
+	case ErrNoPods, ErrNoReadyPods, ErrServiceNotFound, ErrPortNotFound, ErrUnsupportedProtocol:
+		return true
+	}
+	return false
+}
+
+func TestResolveTarget(t *testing.T) {
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		opts       SetupOptions
+		expectErr  error
+		pod        string
+		remotePort int
+	}{
+		{
+			name:      "no pods",
+			objects:   []runtime.Object{makeTestService("fission", makeTestServicePort("http", 8888))},
+			expectErr: ErrNoPods,
+		},
+		{
+			name: "one pod",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestService("fission", makeTestServicePort("http", 8888)),
+			},
+			pod:        "controller-1",
+			remotePort: 8888,
+		},
+		{
+			name: "pods in several namespaces",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestPod("fission-other", "controller-1"),
+				makeTestService("fission", makeTestServicePort("http", 8888)),
+			},
+			expectErr: errMultipleInstalls,
+		},
+		{
+			name: "pods in several namespaces with AllowMultiple",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestPod("fission-other", "controller-2"),
+				makeTestService("fission", makeTestServicePort("http", 8888)),
+			},
+			opts:       SetupOptions{AllowMultiple: true, Strategy: PickOldest},
+			pod:        "controller-1",
+			remotePort: 8888,
+		},
+		{
+			name: "pods in several namespaces with a namespace given",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestPod("fission-other", "controller-2"),
+				makeTestService("fission-other", makeTestServicePort("http", 8888)),
+			},
+			opts:       SetupOptions{Namespace: "fission-other"},
+			pod:        "controller-2",
+			remotePort: 8888,
+		},
+		{
+			name: "no ready pods",
+			objects: []runtime.Object{
+				makeTestPendingPod("fission", "controller-1"),
+				makeTestService("fission", makeTestServicePort("http", 8888)),
+			},
+			expectErr: ErrNoReadyPods,
+		},
+		{
+			name:      "no service",
+			objects:   []runtime.Object{makeTestPod("fission", "controller-1")},
+			expectErr: ErrServiceNotFound,
+		},
+		{
+			name: "multi-port service",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestService("fission",
+					makeTestServicePort("http", 8888),
+					makeTestServicePort("metrics", 9090)),
+			},
+			pod:        "controller-1",
+			remotePort: 8888,
+		},
+		{
+			name: "remote port given without a service",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+			},
+			opts:       SetupOptions{RemotePort: 6060},
+			pod:        "controller-1",
+			remotePort: 6060,
+		},
+		{
+			name: "multi-port service with a port name given",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestService("fission",
+					makeTestServicePort("http", 8888),
+					makeTestServicePort("metrics", 9090)),
+			},
+			opts:       SetupOptions{PortName: "metrics"},
+			pod:        "controller-1",
+			remotePort: 9090,
+		},
+		{
+			name: "several services",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestService("fission", makeTestServicePort("http", 8888)),
+				makeTestNamedService("fission", "controller-debug", makeTestServicePort("debug", 6060)),
+			},
+			expectErr: errMultipleServices,
+		},
+		{
+			name: "several services with a service name given",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestService("fission", makeTestServicePort("http", 8888)),
+				makeTestNamedService("fission", "controller-debug", makeTestServicePort("debug", 6060)),
+			},
+			opts:       SetupOptions{ServiceName: "controller-debug"},
+			pod:        "controller-1",
+			remotePort: 6060,
+		},
+		{
+			name: "UDP service port",
+			objects: []runtime.Object{
+				makeTestPod("fission", "controller-1"),
+				makeTestService("fission", apiv1.ServicePort{
+					Name:       "dns",
+					Port:       53,
+					Protocol:   apiv1.ProtocolUDP,
+					TargetPort: intstr.FromInt(53),
+				}),
+			},
+			expectErr: ErrUnsupportedProtocol,
+		},
+	}
+
+	for _, test := range tests {
+		clientset := fake.NewSimpleClientset(test.objects...)
+		opts := test.opts
+		opts.LabelSelector = testSelector
+
+		target, err := resolveTarget(clientset, opts)
+		if test.expectErr != nil {
+			cause := errors.Cause(err)
+			if _, ok := cause.(*MultipleInstallsError); ok {
+				cause = errMultipleInstalls
+			}
+			if _, ok := cause.(*MultipleServicesError); ok {
+				cause = errMultipleServices
+			}
+			if cause != test.expectErr {
+				t.Errorf("%v: expected error %v, got %v", test.name, test.expectErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+		if target.pod.Name != test.pod {
+			t.Errorf("%v: expected pod %v, got %v", test.name, test.pod, target.pod.Name)
+		}
+		if target.remotePort != test.remotePort {
+			t.Errorf("%v: expected port %v, got %v", test.name, test.remotePort, target.remotePort)
+		}
+	}
+}
+
+func TestFindServicePort(t *testing.T) {
+	// declared out of name and number order, so the first port can't
+	// be picked by sorting
+	service := makeTestService("fission",
+		apiv1.ServicePort{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt(19090)},
+		apiv1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromInt(8888)})
+
+	tests := []struct {
+		portName  string
+		expect    string
+		expectErr bool
+	}{
+		{portName: "", expect: "metrics"},
+		{portName: "http", expect: "http"},
+		{portName: "80", expect: "http"},
+		{portName: "9090", expect: "metrics"},
+		{portName: "grpc", expectErr: true},
+	}
+	for _, test := range tests {
+		port, err := findServicePort(service, test.portName)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got port %v", test.portName, port.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.portName, err)
+			continue
+		}
+		if port.Name != test.expect {
+			t.Errorf("%q: expected port %v, got %v", test.portName, test.expect, port.Name)
+		}
+	}
+}
+
+func TestResolveTargetPort(t *testing.T) {
+	httpPort := apiv1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromInt(8888)}
+	metricsPort := apiv1.ServicePort{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt(9090)}
+
+	tests := []struct {
+		name       string
+		ports      []apiv1.ServicePort
+		portName   string
+		remotePort int
+		expect     int
+		expectErr  bool
+	}{
+		{name: "single port, no name", ports: []apiv1.ServicePort{httpPort}, expect: 8888},
+		{name: "single port by name", ports: []apiv1.ServicePort{httpPort}, portName: "http", expect: 8888},
+		{name: "single port by number", ports: []apiv1.ServicePort{httpPort}, portName: "80", expect: 8888},
+		{name: "single port, other name", ports: []apiv1.ServicePort{httpPort}, portName: "metrics", expectErr: true},
+		// the first port declared, not the last one looked at
+		{name: "multiple ports, no name", ports: []apiv1.ServicePort{httpPort, metricsPort}, expect: 8888},
+		{name: "multiple ports by name", ports: []apiv1.ServicePort{httpPort, metricsPort}, portName: "metrics", expect: 9090},
+		{name: "multiple ports by number", ports: []apiv1.ServicePort{httpPort, metricsPort}, portName: "9090", expect: 9090},
+		{name: "multiple ports, explicit port", ports: []apiv1.ServicePort{httpPort, metricsPort}, remotePort: 6060, expect: 6060},
+	}
+	for _, test := range tests {
+		clientset := fake.NewSimpleClientset(
+			makeTestPod("fission", "controller-1"),
+			makeTestService("fission", test.ports...))
+		target, err := resolveTarget(clientset, SetupOptions{
+			LabelSelector: testSelector,
+			PortName:      test.portName,
+			RemotePort:    test.remotePort,
+		})
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%v: expected an error, got port %v", test.name, target.remotePort)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+		if target.remotePort != test.expect {
+			t.Errorf("%v: expected target port %v, got %v", test.name, test.expect, target.remotePort)
+		}
+	}
+}
+
+func TestResolveTargetPodSelection(t *testing.T) {
+	old := makeTestPod("fission", "controller-a")
+	old.CreationTimestamp = metav1.NewTime(time.Unix(1000, 0))
+	newB := makeTestPod("fission", "controller-b")
+	newB.CreationTimestamp = metav1.NewTime(time.Unix(2000, 0))
+	newC := makeTestPod("fission", "controller-c")
+	newC.CreationTimestamp = metav1.NewTime(time.Unix(2000, 0))
+	service := makeTestService("fission", makeTestServicePort("http", 8888))
+
+	tests := []struct {
+		podName  string
+		strategy PodSelectStrategy
+		expect   string
+	}{
+		// newest wins, with ties broken by name
+		{podName: "", expect: "controller-b"},
+		{podName: "", strategy: PickNewest, expect: "controller-b"},
+		{podName: "", strategy: PickOldest, expect: "controller-a"},
+		{podName: "controller-a", expect: "controller-a"},
+		{podName: "controller-c", strategy: PickOldest, expect: "controller-c"},
+	}
+
+	for _, test := range tests {
+		// repeat a few times, since the fake clientset's ordering
+		// shouldn't matter
+		for i := 0; i < 5; i++ {
+			clientset := fake.NewSimpleClientset(newC, old, newB, service)
+			target, err := resolveTarget(clientset, SetupOptions{
+				LabelSelector: testSelector,
+				PodName:       test.podName,
+				Strategy:      test.strategy,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if target.pod.Name != test.expect {
+				t.Errorf("Expected pod %v, got %v", test.expect, target.pod.Name)
+			}
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(old, service)
+	_, err := resolveTarget(clientset, SetupOptions{
+		LabelSelector: testSelector,
+		PodName:       "controller-z",
+	})
+	if errors.Cause(err) != ErrNoReadyPods {
+		t.Errorf("Expected ErrNoReadyPods for an unknown pod name, got %v", err)
+	}
+}
+
+func TestResolveTargetMultipleInstalls(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestPod("fission-other", "controller-1"))
+
+	_, err := resolveTarget(clientset, SetupOptions{LabelSelector: testSelector})
+	installsErr, ok := errors.Cause(err).(*MultipleInstallsError)
+	if !ok {
+		t.Fatalf("Expected a MultipleInstallsError, got %v", err)
+	}
+	if len(installsErr.Namespaces) != 2 {
+		t.Errorf("Expected 2 namespaces, got %v", installsErr.Namespaces)
+	}
+	if len(installsErr.Pods) != 2 {
+		t.Errorf("Expected 2 candidate pods, got %v", installsErr.Pods)
+	}
+	for _, ref := range []string{"fission/controller-1", "fission-other/controller-1"} {
+		if !strings.Contains(err.Error(), ref) {
+			t.Errorf("Expected %v in the error, got %v", ref, err)
+		}
+	}
+}
+
+func TestResolveTargetSelectPod(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestPod("fission-other", "controller-1"),
+		makeTestService("fission", makeTestServicePort("http", 8888)),
+		makeTestService("fission-other", makeTestServicePort("http", 9999)))
+
+	var candidates []PodRef
+	target, err := resolveTarget(clientset, SetupOptions{
+		LabelSelector: testSelector,
+		SelectPod: func(pods []PodRef) (PodRef, error) {
+			candidates = pods
+			return PodRef{Namespace: "fission-other", Name: "controller-1"}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(candidates) != 2 {
+		t.Errorf("Expected 2 candidates, got %v", candidates)
+	}
+	if target.pod.Namespace != "fission-other" || target.remotePort != 9999 {
+		t.Errorf("Expected fission-other:9999, got %v:%v", target.pod.Namespace, target.remotePort)
+	}
+
+	_, err = resolveTarget(clientset, SetupOptions{
+		LabelSelector: testSelector,
+		SelectPod: func(pods []PodRef) (PodRef, error) {
+			return PodRef{Namespace: "default", Name: "controller-1"}, nil
+		},
+	})
+	if err == nil {
+		t.Errorf("Expected an error selecting a pod that isn't a candidate")
+	}
+}
+
+func TestResolveTargetLabelSelectors(t *testing.T) {
+	pod := makeTestPod("fission", "router-1")
+	pod.Labels = map[string]string{"application": "fission-router"}
+	service := makeTestService("fission", makeTestServicePort("http", 8888))
+	service.Labels = pod.Labels
+	clientset := fake.NewSimpleClientset(pod, service)
+
+	target, err := resolveTarget(clientset, SetupOptions{
+		LabelSelectors: []string{"svc=router", "application=fission-router"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if target.pod.Name != "router-1" {
+		t.Errorf("Expected pod router-1, got %v", target.pod.Name)
+	}
+
+	_, err = resolveTarget(clientset, SetupOptions{
+		LabelSelector:  "svc=router",
+		LabelSelectors: []string{"svc=old-router"},
+	})
+	selectorsErr, ok := errors.Cause(err).(*SelectorsError)
+	if !ok {
+		t.Fatalf("Expected a SelectorsError, got %v", err)
+	}
+	if len(selectorsErr.Selectors) != 2 || selectorsErr.Selectors[0] != "svc=router" {
+		t.Errorf("Expected both selectors to be tried in order, got %v", selectorsErr.Selectors)
+	}
+	for _, selectorErr := range selectorsErr.Errors {
+		if errors.Cause(selectorErr) != ErrNoPods {
+			t.Errorf("Expected ErrNoPods, got %v", selectorErr)
+		}
+	}
+}
+
+func TestContainerReady(t *testing.T) {
+	pod := makeTestPod("fission", "controller-1")
+	pod.Spec.Containers = []apiv1.Container{
+		{Name: "controller", Ports: []apiv1.ContainerPort{{ContainerPort: 8888}}},
+		{Name: "sidecar", Ports: []apiv1.ContainerPort{{ContainerPort: 9090}}},
+	}
+	pod.Status.ContainerStatuses = []apiv1.ContainerStatus{
+		{Name: "controller", Ready: false},
+		{Name: "sidecar", Ready: true},
+	}
+
+	tests := []struct {
+		port      int
+		container string
+		expect    bool
+	}{
+		{port: 8888, expect: false},
+		{port: 9090, expect: true},
+		// undeclared port, so every container must be ready
+		{port: 7070, expect: false},
+		{port: 8888, container: "sidecar", expect: true},
+	}
+	for _, test := range tests {
+		if ready := containerReady(pod, test.port, test.container); ready != test.expect {
+			t.Errorf("Port %v: expected ready %v, got %v", test.port, test.expect, ready)
+		}
+	}
+}
+
+func TestResolveTargetInvalidSelector(t *testing.T) {
+	clientset := fake.NewSimpleClientset(makeTestPod("fission", "controller-1"))
+	_, err := resolveTarget(clientset, SetupOptions{LabelSelector: "application=fission-api,,"})
+	if err == nil || !strings.Contains(err.Error(), "Invalid label selector") {
+		t.Errorf("Expected an invalid selector error, got %v", err)
+	}
+}
+
+func TestWorkloadSelector(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "controller", Namespace: "fission"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"svc": "controller"}},
+		},
+	}
+	clientset := fake.NewSimpleClientset(deployment)
+
+	selector, err := workloadSelector(clientset, SetupOptions{}, "fission", "deployment", "controller")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if selector != "svc=controller" {
+		t.Errorf("Expected selector svc=controller, got %v", selector)
+	}
+
+	_, err = workloadSelector(clientset, SetupOptions{}, "fission", "statefulset", "controller")
+	if err == nil {
+		t.Errorf("Expected an error for a missing StatefulSet")
+	}
+	_, err = workloadSelector(clientset, SetupOptions{}, "fission", "daemonset", "controller")
+	if err == nil {
+		t.Errorf("Expected an error for an unsupported kind")
+	}
+}
+
+func TestResolveTargetContainer(t *testing.T) {
+	pod := makeTestPod("fission", "controller-1")
+	pod.Spec.Containers = []apiv1.Container{
+		{Name: "sidecar", Ports: []apiv1.ContainerPort{{Name: "http", ContainerPort: 9090}}},
+		{Name: "controller", Ports: []apiv1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+	}
+	service := makeTestService("fission",
+		apiv1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromString("http")})
+	clientset := fake.NewSimpleClientset(pod, service)
+
+	tests := []struct {
+		container  string
+		remotePort int
+		expectErr  bool
+	}{
+		// without a container, the first declaring the port name wins
+		{container: "", remotePort: 9090},
+		{container: "controller", remotePort: 8080},
+		{container: "controller", remotePort: 9090, expectErr: true},
+		{container: "missing", expectErr: true},
+	}
+	for _, test := range tests {
+		opts := SetupOptions{LabelSelector: testSelector, Container: test.container}
+		if test.expectErr {
+			// an explicit port the container doesn't expose
+			opts.RemotePort = test.remotePort
+		}
+		target, err := resolveTarget(clientset, opts)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%v: expected an error for port %v", test.container, test.remotePort)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.container, err)
+			continue
+		}
+		if target.remotePort != test.remotePort {
+			t.Errorf("%v: expected port %v, got %v", test.container, test.remotePort, target.remotePort)
+		}
+	}
+}
+
+func TestCheckNode(t *testing.T) {
+	pod := makeTestPod("fission", "controller-1")
+	pod.Spec.NodeName = "node-1"
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status: apiv1.NodeStatus{
+			Conditions: []apiv1.NodeCondition{
+				{Type: apiv1.NodeReady, Status: apiv1.ConditionUnknown, Reason: "NodeStatusUnknown"},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(node)
+
+	logger := &testLogger{}
+	err := checkNode(clientset, SetupOptions{Logger: logger}, pod)
+	if err != nil {
+		t.Errorf("Expected only a warning, got %v", err)
+	}
+	if len(logger.messages) != 1 || !strings.Contains(logger.messages[0], "node-1") {
+		t.Errorf("Expected a warning about node-1, got %v", logger.messages)
+	}
+
+	err = checkNode(clientset, SetupOptions{Logger: logger, RequireReadyNode: true}, pod)
+	if err == nil {
+		t.Errorf("Expected an error with RequireReadyNode")
+	}
+
+	// a node we can't get isn't held against the pod
+	pod.Spec.NodeName = "node-2"
+	err = checkNode(clientset, SetupOptions{Logger: logger, RequireReadyNode: true}, pod)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestResolvePodByName(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestPendingPod("fission", "controller-2"))
+
+	target, err := resolveTarget(clientset, SetupOptions{
+		Namespace:  "fission",
+		PodName:    "controller-1",
+		RemotePort: 6060,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if target.pod.Name != "controller-1" || target.remotePort != 6060 {
+		t.Errorf("Expected controller-1:6060, got %v:%v", target.pod.Name, target.remotePort)
+	}
+
+	_, err = resolveTarget(clientset, SetupOptions{Namespace: "fission", PodName: "controller-3", RemotePort: 6060})
+	if errors.Cause(err) != ErrNoPods {
+		t.Errorf("Expected ErrNoPods for a missing pod, got %v", err)
+	}
+
+	_, err = resolveTarget(clientset, SetupOptions{Namespace: "fission", PodName: "controller-2", RemotePort: 6060})
+	if errors.Cause(err) != ErrNoReadyPods {
+		t.Errorf("Expected ErrNoReadyPods for a pending pod, got %v", err)
+	}
+}
+
+func TestResolveNamedTargetPort(t *testing.T) {
+	pod := makeTestPod("fission", "controller-1")
+	pod.Spec.Containers = []apiv1.Container{{
+		Name:  "controller",
+		Ports: []apiv1.ContainerPort{{Name: "http", ContainerPort: 8888}},
+	}}
+	named := apiv1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromString("http")}
+	missing := apiv1.ServicePort{Name: "metrics", Port: 9090, TargetPort: intstr.FromString("metrics")}
+	unset := apiv1.ServicePort{Name: "default", Port: 8080}
+
+	tests := []struct {
+		portName   string
+		remotePort int
+		expectErr  bool
+	}{
+		{portName: "http", remotePort: 8888},
+		{portName: "metrics", expectErr: true},
+		{portName: "default", remotePort: 8080},
+	}
+
+	for _, test := range tests {
+		clientset := fake.NewSimpleClientset(pod, makeTestService("fission", named, missing, unset))
+		target, err := resolveTarget(clientset, SetupOptions{
+			LabelSelector: testSelector,
+			PortName:      test.portName,
+		})
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%v: expected an error, got port %v", test.portName, target.remotePort)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.portName, err)
+			continue
+		}
+		if target.remotePort != test.remotePort {
+			t.Errorf("%v: expected port %v, got %v", test.portName, test.remotePort, target.remotePort)
+		}
+	}
+}
+
+func TestWaitForService(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	_, err := WaitForService(clientset, "fission", testSelector, 3, time.Millisecond)
+	if errors.Cause(err) != ErrServiceNotFound {
+		t.Errorf("Expected ErrServiceNotFound, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		clientset.CoreV1().Services("fission").Create(makeTestService("fission", makeTestServicePort("http", 8888)))
+	}()
+	service, err := WaitForService(clientset, "fission", testSelector, 100, 5*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if service.Name != "controller" {
+		t.Errorf("Expected service controller, got %v", service.Name)
+	}
+}
+
+// listOptionsClientset records the options of each pod List call, which
+// the fake clientset drops before they reach its reactors.
+type listOptionsClientset struct {
+	*fake.Clientset
+	listOptions []metav1.ListOptions
+}
+
+func (c *listOptionsClientset) CoreV1() corev1.CoreV1Interface {
+	return &listOptionsCoreV1{c.Clientset.CoreV1(), c}
+}
+
+type listOptionsCoreV1 struct {
+	corev1.CoreV1Interface
+	clientset *listOptionsClientset
+}
+
+func (c *listOptionsCoreV1) Pods(namespace string) corev1.PodInterface {
+	return &listOptionsPods{c.CoreV1Interface.Pods(namespace), c.clientset}
+}
+
+type listOptionsPods struct {
+	corev1.PodInterface
+	clientset *listOptionsClientset
+}
+
+func (p *listOptionsPods) List(opts metav1.ListOptions) (*apiv1.PodList, error) {
+	p.clientset.listOptions = append(p.clientset.listOptions, opts)
+	return p.PodInterface.List(opts)
+}
+
+func TestResolveTargetSkipPods(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestPod("fission", "controller-2"),
+		makeTestService("fission", makeTestServicePort("http", 8888)))
+
+	opts := SetupOptions{
+		LabelSelector: testSelector,
+		skipPods:      []PodRef{{Namespace: "fission", Name: "controller-1"}},
+	}
+	target, err := resolveTarget(clientset, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if target.pod.Name != "controller-2" {
+		t.Errorf("Expected the pod that wasn't skipped, got %v", target.pod.Name)
+	}
+
+	opts.skipPods = append(opts.skipPods, PodRef{Namespace: "fission", Name: "controller-2"})
+	_, err = resolveTarget(clientset, opts)
+	if errors.Cause(err) != ErrNoReadyPods {
+		t.Errorf("Expected ErrNoReadyPods with every pod skipped, got %v", err)
+	}
+}
+
+func makeTestEndpoints(namespace string, port int, ready []string, notReady []string) *apiv1.Endpoints {
+	addresses := func(names []string) []apiv1.EndpointAddress {
+		var addresses []apiv1.EndpointAddress
+		for _, name := range names {
+			addresses = append(addresses, apiv1.EndpointAddress{
+				TargetRef: &apiv1.ObjectReference{Kind: "Pod", Namespace: namespace, Name: name},
+			})
+		}
+		return addresses
+	}
+	return &apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "controller", Namespace: namespace},
+		Subsets: []apiv1.EndpointSubset{{
+			Addresses:         addresses(ready),
+			NotReadyAddresses: addresses(notReady),
+			Ports:             []apiv1.EndpointPort{{Name: "http", Port: int32(port)}},
+		}},
+	}
+}
+
+func TestResolveTargetEndpoints(t *testing.T) {
+	// controller-1 is gone, but the endpoints haven't caught up
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-2"),
+		makeTestPod("fission", "controller-3"),
+		makeTestService("fission", makeTestServicePort("http", 8888)),
+		makeTestEndpoints("fission", 8888, []string{"controller-1", "controller-2"}, []string{"controller-3"}))
+
+	opts := SetupOptions{LabelSelector: testSelector, UseEndpoints: true}
+	target, err := resolveTarget(clientset, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if target.pod.Name != "controller-2" || target.remotePort != 8888 || target.service.Name != "controller" {
+		t.Errorf("Expected port 8888 on controller-2 behind the service, got port %v on %v", target.remotePort, target.pod.Name)
+	}
+
+	// after the service moves on, so does the next resolve
+	_, err = clientset.CoreV1().Endpoints("fission").Update(
+		makeTestEndpoints("fission", 9999, []string{"controller-3"}, nil))
+	if err != nil {
+		t.Fatalf("Error updating endpoints: %v", err)
+	}
+	target, err = resolveTarget(clientset, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if target.pod.Name != "controller-3" || target.remotePort != 9999 {
+		t.Errorf("Expected port 9999 on controller-3, got port %v on %v", target.remotePort, target.pod.Name)
+	}
+
+	opts.skipPods = []PodRef{{Namespace: "fission", Name: "controller-3"}}
+	_, err = resolveTarget(clientset, opts)
+	if errors.Cause(err) != ErrNoReadyPods {
+		t.Errorf("Expected ErrNoReadyPods with no ready endpoint left, got %v", err)
+	}
+
+	err = clientset.CoreV1().Endpoints("fission").Delete("controller", nil)
+	if err != nil {
+		t.Fatalf("Error deleting endpoints: %v", err)
+	}
+	_, err = resolveTarget(clientset, SetupOptions{LabelSelector: testSelector, UseEndpoints: true})
+	if errors.Cause(err) != ErrNoPods {
+		t.Errorf("Expected ErrNoPods without endpoints, got %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestPod("fission", "controller-2"),
+		makeTestPendingPod("fission", "controller-3"),
+		makeTestService("fission", makeTestServicePort("http", 8888)))
+
+	pods, service, err := resolve(clientset, SetupOptions{LabelSelector: testSelector}.withDefaults())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pods) != 2 {
+		t.Errorf("Expected the 2 ready pods, got %v", pods)
+	}
+	expected := ServiceRef{Namespace: "fission", Name: "controller", Port: 80, TargetPort: 8888}
+	if service == nil || *service != expected {
+		t.Errorf("Expected service %v, got %v", expected, service)
+	}
+}
+
+func TestWaitForReadyPod(t *testing.T) {
+	clientset := fake.NewSimpleClientset(makeTestPendingPod("fission", "controller-1"))
+	opts := SetupOptions{LabelSelector: testSelector, WaitForPod: 5 * time.Second}.withDefaults()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitForReadyPod(clientset, opts, nil)
+	}()
+
+	// the fake clientset's watch only sees changes made once it's set
+	// up, so keep making the pod ready until the wait notices
+	ready := makeTestPod("fission", "controller-1")
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			_, err := clientset.CoreV1().Pods("fission").Update(ready)
+			if err != nil {
+				t.Fatalf("Error updating pod: %v", err)
+			}
+		}
+	}
+}
+
+func TestWaitForReadyPodName(t *testing.T) {
+	// a pod picked by name alone is in the default namespace, so the
+	// same name getting ready elsewhere doesn't end the wait
+	clientset := fake.NewSimpleClientset(
+		makeTestPendingPod(metav1.NamespaceDefault, "controller-1"),
+		makeTestPendingPod("fission", "controller-1"))
+	opts := SetupOptions{PodName: "controller-1", RemotePort: 8888, WaitForPod: 200 * time.Millisecond}.withDefaults()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitForReadyPod(clientset, opts, nil)
+	}()
+	elsewhere := makeTestPod("fission", "controller-1")
+	for {
+		select {
+		case err := <-done:
+			if errors.Cause(err) != ErrNoReadyPods {
+				t.Errorf("Expected to time out with ErrNoReadyPods, got %v", err)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			_, err := clientset.CoreV1().Pods("fission").Update(elsewhere)
+			if err != nil {
+				t.Fatalf("Error updating pod: %v", err)
+			}
+		}
+	}
+}
+
+func TestWaitForReadyPodWithoutWatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset(makeTestPendingPod("fission", "controller-1"))
+	clientset.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", errors.New("no watching"))
+	})
+
+	err := waitForReadyPod(clientset, SetupOptions{
+		LabelSelector: testSelector,
+		WaitForPod:    10 * time.Millisecond,
+	}.withDefaults(), nil)
+	if errors.Cause(err) != ErrNoReadyPods {
+		t.Errorf("Expected to time out with ErrNoReadyPods, got %v", err)
+	}
+}
+
+func TestWaitForReadyPodLabelSelectors(t *testing.T) {
+	clientset := fake.NewSimpleClientset(makeTestPendingPod("fission", "controller-1"))
+	opts := SetupOptions{
+		LabelSelectors: []string{"application=fission-controller", testSelector},
+		WaitForPod:     10 * time.Millisecond,
+	}.withDefaults()
+
+	_, err := resolveTarget(clientset, opts)
+	if _, ok := err.(*SelectorsError); !ok || !noPodsYet(err) {
+		t.Fatalf("Expected a SelectorsError for no ready pods, got %v", err)
+	}
+	err = waitForReadyPod(clientset, opts, nil)
+	if errors.Cause(err) != ErrNoReadyPods {
+		t.Errorf("Expected to time out with ErrNoReadyPods, got %v", err)
+	}
+
+	// a pod getting ready for one of the selectors ends the wait
+	opts.WaitForPod = 5 * time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		clientset.CoreV1().Pods("fission").Update(makeTestPod("fission", "controller-1"))
+	}()
+	err = waitForReadyPod(clientset, opts, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = resolveTarget(clientset, SetupOptions{LabelSelectors: opts.LabelSelectors, RemotePort: 8888})
+	if err != nil {
+		t.Errorf("Unexpected error resolving after the wait: %v", err)
+	}
+}
+
+func TestNoPodsYet(t *testing.T) {
+	tests := []struct {
+		err    error
+		expect bool
+	}{
+		{err: nil, expect: false},
+		{err: errors.Wrap(ErrNoPods, "no pods"), expect: true},
+		{err: errors.Wrap(ErrNoReadyPods, "not ready"), expect: true},
+		{err: errors.New("forbidden"), expect: false},
+		{err: &SelectorsError{}, expect: false},
+		{err: &SelectorsError{
+			Selectors: []string{"a=b", "c=d"},
+			Errors:    []error{errors.Wrap(ErrNoPods, "no pods"), errors.Wrap(ErrNoReadyPods, "not ready")},
+		}, expect: true},
+		{err: &SelectorsError{
+			Selectors: []string{"a=b", "c=d"},
+			Errors:    []error{errors.Wrap(ErrNoPods, "no pods"), errors.New("forbidden")},
+		}, expect: false},
+	}
+	for _, test := range tests {
+		if noPodsYet(test.err) != test.expect {
+			t.Errorf("%v: expected %v", test.err, test.expect)
+		}
+	}
+}
+
+func TestPickPod(t *testing.T) {
+	pods := []apiv1.Pod{*makeTestPod("fission", "controller-b"), *makeTestPod("fission", "controller-a")}
+
+	pod, err := pickPod(pods, PickFirst)
+	if err != nil || pod.Name != "controller-b" {
+		t.Errorf("Expected the first pod, got %v, %v", pod, err)
+	}
+	for i := 0; i < 5; i++ {
+		pod, err = pickPod(pods, PickRandom)
+		if err != nil || (pod.Name != "controller-a" && pod.Name != "controller-b") {
+			t.Errorf("Expected one of the pods, got %v, %v", pod, err)
+		}
+	}
+	_, err = pickPod(pods, "fastest")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown strategy")
+	}
+}
+
+func TestResolveTargetPodListLimit(t *testing.T) {
+	clientset := &listOptionsClientset{Clientset: fake.NewSimpleClientset(
+		makeTestPod("fission", "controller-1"),
+		makeTestService("fission", makeTestServicePort("http", 8888)),
+	)}
+
+	_, err := resolveTarget(clientset, SetupOptions{
+		Namespace:     "fission",
+		LabelSelector: testSelector,
+		FieldSelector: "spec.nodeName=node-1",
+		PodListLimit:  1,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(clientset.listOptions) != 1 {
+		t.Fatalf("Expected 1 pod List call, got %v", len(clientset.listOptions))
+	}
+	listOptions := clientset.listOptions[0]
+	if listOptions.Limit != 1 {
+		t.Errorf("Expected limit 1, got %v", listOptions.Limit)
+	}
+	if listOptions.FieldSelector != "spec.nodeName=node-1,status.phase=Running" {
+		t.Errorf("Unexpected field selector %q", listOptions.FieldSelector)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// maxAPIRetryInterval caps the backoff between API call retries
+	maxAPIRetryInterval = 10 * time.Second
+
+	// maxPollInterval caps the backoff of poll loops, unless they start
+	// out slower than that
+	maxPollInterval = time.Second
+
+	// pollJitter is how much longer than the interval, as a fraction of
+	// it, a poll loop may wait at random
+	pollJitter = 0.5
+)
+
+// retryAPI calls fn until it succeeds, fails with an error that isn't
+// worth retrying, or has been tried opts.APIAttempts times.
+func retryAPI(opts SetupOptions, fn func() error) error {
+	interval := opts.APIRetryInterval
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || i >= opts.APIAttempts || !isRetryable(err) {
+			return err
+		}
+		opts.logger().Verbose(2, "Error talking to Kubernetes API, retrying in %v: %v", interval, err)
+		time.Sleep(interval)
+
+		interval *= 2
+		if interval > maxAPIRetryInterval {
+			interval = maxAPIRetryInterval
+		}
+	}
+}
+
+// pollBackoff spaces out the tries of a poll loop, so that many forwards
+// polling at once don't do it in lockstep: each wait is the interval
+// plus random jitter, and the interval doubles up to maxPollInterval.
+type pollBackoff struct {
+	interval time.Duration
+	max      time.Duration
+}
+
+func makePollBackoff(interval time.Duration) *pollBackoff {
+	max := maxPollInterval
+	if interval > max {
+		max = interval
+	}
+	return &pollBackoff{interval: interval, max: max}
+}
+
+// next returns how long to wait before the next try.
+func (b *pollBackoff) next() time.Duration {
+	interval := wait.Jitter(b.interval, pollJitter)
+	b.interval *= 2
+	if b.interval > b.max {
+		b.interval = b.max
+	}
+	return interval
+}
+
+// isRetryable says whether err is likely to go away on retrying: network
+// errors, server errors and throttling are; anything else, like not
+// found or forbidden, isn't.
+func isRetryable(err error) bool {
+	err = errors.Cause(err)
+	if _, ok := err.(*k8serrors.StatusError); ok {
+		return k8serrors.IsInternalError(err) ||
+			k8serrors.IsServerTimeout(err) ||
+			k8serrors.IsTimeout(err) ||
+			k8serrors.IsServiceUnavailable(err) ||
+			k8serrors.IsTooManyRequests(err) ||
+			k8serrors.IsUnexpectedServerError(err)
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
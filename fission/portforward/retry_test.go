@@ -0,0 +1,105 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestResolveTargetRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		calls     int
+		expectErr bool
+	}{
+		{
+			name:  "server error",
+			err:   k8serrors.NewInternalError(errors.New("etcd is sad")),
+			calls: 2,
+		},
+		{
+			name:  "throttled",
+			err:   k8serrors.NewTooManyRequests("slow down", 1),
+			calls: 2,
+		},
+		{
+			name:      "forbidden",
+			err:       k8serrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", errors.New("no")),
+			calls:     1,
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		clientset := fake.NewSimpleClientset(
+			makeTestPod("fission", "controller-1"),
+			makeTestService("fission", makeTestServicePort("http", 8888)))
+
+		// fail the first pod list
+		calls := 0
+		clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			calls++
+			if calls == 1 {
+				return true, nil, test.err
+			}
+			return false, nil, nil
+		})
+
+		_, err := resolveTarget(clientset, SetupOptions{
+			LabelSelector:    testSelector,
+			APIAttempts:      3,
+			APIRetryInterval: time.Millisecond,
+		})
+		if test.expectErr && err == nil {
+			t.Errorf("%v: expected an error", test.name)
+		}
+		if !test.expectErr && err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+		}
+		if calls != test.calls {
+			t.Errorf("%v: expected %v pod lists, got %v", test.name, test.calls, calls)
+		}
+	}
+}
+
+func TestPollBackoff(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		expected []time.Duration
+	}{
+		{100 * time.Millisecond, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}},
+		{2 * time.Second, []time.Duration{2 * time.Second, 2 * time.Second}},
+	}
+	for _, test := range tests {
+		backoff := makePollBackoff(test.interval)
+		for i, expected := range test.expected {
+			interval := backoff.next()
+			if interval < expected || interval > expected+time.Duration(pollJitter*float64(expected)) {
+				t.Errorf("Wait %v starting from %v: expected %v plus jitter, got %v", i, test.interval, expected, interval)
+			}
+		}
+	}
+}
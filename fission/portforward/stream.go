@@ -0,0 +1,382 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+// portForwarder copies connections accepted on a local listener to a
+// port on a pod, over an upgraded connection to the API server.
+//
+// This does what client-go's tools/portforward does, except that it
+// serves a listener we own: the client-go version we vendor always
+// binds localhost itself, so it can't honor a bind address.
+type portForwarder struct {
+	listener net.Listener
+	logger   Logger
+
+	// out and errOut, if set, get the forward's messages and errors
+	// instead of logger
+	out    io.Writer
+	errOut io.Writer
+
+	// bytes, if set, counts the data copied through the forward
+	bytes *byteCounts
+
+	// conns, if set, counts serve while it runs and the connections
+	// being forwarded
+	conns *connCount
+
+	connLock sync.Mutex
+	conn     *podConnection
+
+	requestIDLock sync.Mutex
+	requestID     int
+
+	recentErrorsLock sync.Mutex
+	recentErrors     []error
+}
+
+// byteCounts are the bytes copied from the pod to local connections,
+// and from local connections to the pod.
+type byteCounts struct {
+	in  int64
+	out int64
+}
+
+// countingWriter adds the bytes written through it to *n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// connCount counts things in flight, and tells waiters when there are
+// none left.
+type connCount struct {
+	lock    sync.Mutex
+	n       int
+	waiters []chan struct{}
+}
+
+func (c *connCount) add(delta int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.n += delta
+	if c.n == 0 {
+		for _, waiter := range c.waiters {
+			close(waiter)
+		}
+		c.waiters = nil
+	}
+}
+
+// idle returns a channel that's closed once the count is zero.
+func (c *connCount) idle() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	waiter := make(chan struct{})
+	if c.n == 0 {
+		close(waiter)
+	} else {
+		c.waiters = append(c.waiters, waiter)
+	}
+	return waiter
+}
+
+const (
+	// maxRecentErrors is how many stream errors a portForwarder
+	// remembers.
+	maxRecentErrors = 5
+
+	// remotePortCheckTimeout is how long checkRemotePort waits to hear
+	// back from the pod.
+	remotePortCheckTimeout = 5 * time.Second
+)
+
+// podConnection is an upgraded connection to a pod's portforward
+// subresource.
+type podConnection struct {
+	podName      string
+	podNamespace string
+	remotePort   int
+	service      *apiv1.Service
+	streamConn   httpstream.Connection
+
+	// active counts the local connections forwarded over streamConn,
+	// shared with the copies withPort makes
+	active *connCount
+}
+
+// withPort returns a copy of conn that forwards to port on the same pod
+// instead, over the same upgraded connection.
+func (conn *podConnection) withPort(port int) *podConnection {
+	portConn := *conn
+	portConn.remotePort = port
+	return &portConn
+}
+
+// setConnection switches new local connections over to conn, e.g.
+// after a reconnect.
+func (pf *portForwarder) setConnection(conn *podConnection) {
+	pf.connLock.Lock()
+	defer pf.connLock.Unlock()
+	pf.conn = conn
+}
+
+func (pf *portForwarder) connection() *podConnection {
+	pf.connLock.Lock()
+	defer pf.connLock.Unlock()
+	return pf.conn
+}
+
+// acquireConnection returns the connection to forward a new local
+// connection over, counted as in use until the returned func is
+// called. It's counted before setConnection can switch away from it,
+// so draining the old connection can't miss it.
+func (pf *portForwarder) acquireConnection() (*podConnection, func()) {
+	pf.connLock.Lock()
+	defer pf.connLock.Unlock()
+	conn := pf.conn
+	if conn.active == nil {
+		return conn, func() {}
+	}
+	conn.active.add(1)
+	return conn, func() { conn.active.add(-1) }
+}
+
+// serve accepts connections until the listener is closed. The caller
+// counts serve in pf.conns before starting it, if that's set.
+func (pf *portForwarder) serve() {
+	if pf.conns != nil {
+		defer pf.conns.add(-1)
+	}
+	for {
+		conn, err := pf.listener.Accept()
+		if err != nil {
+			if !strings.Contains(strings.ToLower(err.Error()), "use of closed network connection") {
+				pf.logError(fmt.Errorf("Error accepting connection on %v: %v", pf.listener.Addr(), err))
+			}
+			return
+		}
+		if pf.conns != nil {
+			pf.conns.add(1)
+		}
+		go pf.handleConnection(conn)
+	}
+}
+
+func (pf *portForwarder) nextRequestID() int {
+	pf.requestIDLock.Lock()
+	defer pf.requestIDLock.Unlock()
+	id := pf.requestID
+	pf.requestID++
+	return id
+}
+
+// handleConnection copies data between the local connection and a new
+// data stream to the pod.
+func (pf *portForwarder) handleConnection(conn net.Conn) {
+	if pf.conns != nil {
+		defer pf.conns.add(-1)
+	}
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			pf.logError(panicError(r))
+		}
+	}()
+
+	podConn, release := pf.acquireConnection()
+	defer release()
+	remotePort := podConn.remotePort
+
+	if pf.out != nil {
+		fmt.Fprintf(pf.out, "Handling connection for %v\n", pf.listener.Addr())
+	} else {
+		pf.logger.Verbose(2, "Handling connection for %v", pf.listener.Addr())
+	}
+
+	errorStream, dataStream, err := pf.createStreams(podConn)
+	if err != nil {
+		pf.logError(err)
+		return
+	}
+
+	errorChan := make(chan error)
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errorChan <- fmt.Errorf("Error reading from error stream for port %v: %v", remotePort, err)
+		case len(message) > 0:
+			errorChan <- fmt.Errorf("An error occurred forwarding to port %v: %v", remotePort, string(message))
+		}
+		close(errorChan)
+	}()
+
+	localError := make(chan struct{})
+	remoteDone := make(chan struct{})
+
+	var toLocal, toRemote io.Writer = conn, dataStream
+	if pf.bytes != nil {
+		toLocal = countingWriter{conn, &pf.bytes.in}
+		toRemote = countingWriter{dataStream, &pf.bytes.out}
+	}
+
+	go func() {
+		// copy from the remote side to the local port
+		_, err := io.Copy(toLocal, dataStream)
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			pf.logError(fmt.Errorf("Error copying from remote stream to local connection: %v", err))
+		}
+		close(remoteDone)
+	}()
+
+	go func() {
+		// tell the server we're not sending any more data once the copy is done
+		defer dataStream.Close()
+
+		// copy from the local port to the remote side
+		_, err := io.Copy(toRemote, conn)
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			pf.logError(fmt.Errorf("Error copying from local connection to remote stream: %v", err))
+			close(localError)
+		}
+	}()
+
+	// wait for either a local->remote error or for remote->local to finish
+	select {
+	case <-remoteDone:
+	case <-localError:
+	}
+
+	// there's always something on errorChan, even if it's nil
+	err = <-errorChan
+	if err != nil {
+		pf.logError(err)
+	}
+}
+
+// createStreams creates the error and data streams for forwarding one
+// connection to the pod.
+func (pf *portForwarder) createStreams(podConn *podConnection) (httpstream.Stream, httpstream.Stream, error) {
+	streamConn, remotePort := podConn.streamConn, podConn.remotePort
+	requestID := pf.nextRequestID()
+
+	// create error stream
+	headers := http.Header{}
+	headers.Set(apiv1.StreamType, apiv1.StreamTypeError)
+	headers.Set(apiv1.PortHeader, strconv.Itoa(remotePort))
+	headers.Set(apiv1.PortForwardRequestIDHeader, strconv.Itoa(requestID))
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating error stream for port %v: %v", remotePort, err)
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+
+	// create data stream
+	headers.Set(apiv1.StreamType, apiv1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		errorStream.Reset()
+		return nil, nil, fmt.Errorf("Error creating forwarding stream for port %v: %v", remotePort, err)
+	}
+	return errorStream, dataStream, nil
+}
+
+// probe forwards an empty connection to the pod, to check that podConn
+// still works and to keep it from being reaped as idle.
+func (pf *portForwarder) probe(podConn *podConnection) error {
+	errorStream, dataStream, err := pf.createStreams(podConn)
+	if err != nil {
+		return err
+	}
+	dataStream.Close()
+	go io.Copy(ioutil.Discard, errorStream)
+	return nil
+}
+
+// checkRemotePort forwards an empty connection to the pod and waits up
+// to remotePortCheckTimeout for the pod to report whether anything is
+// listening on the remote port. No word in that time counts as
+// listening, since the server behind the port may just be slow to hang
+// up.
+func (pf *portForwarder) checkRemotePort(podConn *podConnection) error {
+	errorStream, dataStream, err := pf.createStreams(podConn)
+	if err != nil {
+		return err
+	}
+	dataStream.Close()
+
+	messageChan := make(chan []byte, 1)
+	go func() {
+		message, _ := ioutil.ReadAll(errorStream)
+		messageChan <- message
+	}()
+	select {
+	case message := <-messageChan:
+		if len(message) > 0 {
+			return fmt.Errorf("%s", message)
+		}
+	case <-time.After(remotePortCheckTimeout):
+	}
+	return nil
+}
+
+// logError reports an error forwarding a connection, and remembers it
+// so it can be included in the error the forward eventually fails with.
+func (pf *portForwarder) logError(err error) {
+	if pf.errOut != nil {
+		fmt.Fprintln(pf.errOut, err.Error())
+	} else {
+		pf.logger.Warn(err.Error())
+	}
+
+	pf.recentErrorsLock.Lock()
+	defer pf.recentErrorsLock.Unlock()
+	pf.recentErrors = append(pf.recentErrors, err)
+	if len(pf.recentErrors) > maxRecentErrors {
+		pf.recentErrors = pf.recentErrors[len(pf.recentErrors)-maxRecentErrors:]
+	}
+}
+
+// streamErrors returns the most recent errors forwarding connections.
+func (pf *portForwarder) streamErrors() []error {
+	pf.recentErrorsLock.Lock()
+	defer pf.recentErrorsLock.Unlock()
+	return append([]error(nil), pf.recentErrors...)
+}
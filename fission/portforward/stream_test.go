@@ -0,0 +1,213 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+func TestLogError(t *testing.T) {
+	var errOut bytes.Buffer
+	pf := &portForwarder{logger: &testLogger{}, errOut: &errOut}
+	for i := 0; i < maxRecentErrors+2; i++ {
+		pf.logError(fmt.Errorf("Error %v", i))
+	}
+
+	if !strings.Contains(errOut.String(), "Error 0\n") {
+		t.Errorf("Expected errors to be written to ErrStream, got %q", errOut.String())
+	}
+	if len(pf.logger.(*testLogger).messages) != 0 {
+		t.Errorf("Expected nothing logged with ErrStream set")
+	}
+
+	// only the most recent ones are kept
+	streamErrors := pf.streamErrors()
+	if len(streamErrors) != maxRecentErrors || streamErrors[0].Error() != "Error 2" {
+		t.Errorf("Expected the last %v errors, got %v", maxRecentErrors, streamErrors)
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var n int64
+	w := countingWriter{&buf, &n}
+	fmt.Fprint(w, "hello ")
+	fmt.Fprint(w, "world")
+	if n != 11 || buf.String() != "hello world" {
+		t.Errorf("Expected 11 bytes of %q, got %v of %q", "hello world", n, buf.String())
+	}
+}
+
+// fakeStream is a stream that reads from its Reader and discards writes.
+type fakeStream struct {
+	*strings.Reader
+	headers http.Header
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) { return len(p), nil }
+func (s *fakeStream) Close() error                { return nil }
+func (s *fakeStream) Reset() error                { return nil }
+func (s *fakeStream) Headers() http.Header        { return s.headers }
+func (s *fakeStream) Identifier() uint32          { return 0 }
+
+// fakeHeldStream is a data stream that stays open, like one to a
+// server in the middle of a request, until it or its connection is
+// closed.
+type fakeHeldStream struct {
+	headers    http.Header
+	connClosed <-chan bool
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func (s *fakeHeldStream) Read(p []byte) (int, error) {
+	select {
+	case <-s.closed:
+	case <-s.connClosed:
+	}
+	return 0, io.EOF
+}
+
+func (s *fakeHeldStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func (s *fakeHeldStream) Write(p []byte) (int, error) { return len(p), nil }
+func (s *fakeHeldStream) Reset() error                { return s.Close() }
+func (s *fakeHeldStream) Headers() http.Header        { return s.headers }
+func (s *fakeHeldStream) Identifier() uint32          { return 0 }
+
+// fakeConnection is a connection to a pod whose error streams report
+// errorMessage. It's lost once closed. With streamErr, creating
+// streams fails; with holdData, data streams are fakeHeldStreams.
+type fakeConnection struct {
+	errorMessage string
+	streamErr    error
+	holdData     bool
+
+	// dataStreams counts the data streams created
+	dataStreams int32
+
+	initOnce  sync.Once
+	closeOnce sync.Once
+	closed    chan bool
+}
+
+func (c *fakeConnection) init() {
+	c.initOnce.Do(func() {
+		c.closed = make(chan bool)
+	})
+}
+
+func (c *fakeConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	if c.streamErr != nil {
+		return nil, c.streamErr
+	}
+	message := ""
+	if headers.Get(apiv1.StreamType) == apiv1.StreamTypeError {
+		message = c.errorMessage
+	} else {
+		atomic.AddInt32(&c.dataStreams, 1)
+		if c.holdData {
+			return &fakeHeldStream{
+				headers:    headers,
+				connClosed: c.CloseChan(),
+				closed:     make(chan struct{}),
+			}, nil
+		}
+	}
+	return &fakeStream{strings.NewReader(message), headers}, nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.init()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *fakeConnection) CloseChan() <-chan bool {
+	c.init()
+	return c.closed
+}
+
+func (c *fakeConnection) isClosed() bool {
+	select {
+	case <-c.CloseChan():
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *fakeConnection) SetIdleTimeout(timeout time.Duration) {}
+
+func TestCheckRemotePort(t *testing.T) {
+	tests := []struct {
+		errorMessage string
+		expectErr    bool
+	}{
+		{errorMessage: "", expectErr: false},
+		{errorMessage: "dial tcp4 127.0.0.1:8888: connect: connection refused", expectErr: true},
+	}
+	for _, test := range tests {
+		pf := &portForwarder{logger: &testLogger{}, errOut: ioutil.Discard}
+		err := pf.checkRemotePort(&podConnection{
+			remotePort: 8888,
+			streamConn: &fakeConnection{errorMessage: test.errorMessage},
+		})
+		if test.expectErr != (err != nil) {
+			t.Errorf("%q: expected error %v, got %v", test.errorMessage, test.expectErr, err)
+		}
+	}
+}
+
+func TestPodConnectionWithPort(t *testing.T) {
+	streamConn := &fakeConnection{}
+	conn := &podConnection{podName: "controller", podNamespace: "fission", remotePort: 8888, streamConn: streamConn}
+	pprofConn := conn.withPort(6060)
+	if pprofConn.streamConn != streamConn || pprofConn.podName != "controller" || conn.remotePort != 8888 {
+		t.Fatalf("Expected the same connection to port 6060, got %+v, leaving %+v", pprofConn, conn)
+	}
+
+	pf := &portForwarder{logger: &testLogger{}, errOut: ioutil.Discard}
+	errorStream, dataStream, err := pf.createStreams(pprofConn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, stream := range []httpstream.Stream{errorStream, dataStream} {
+		if port := stream.Headers().Get(apiv1.PortHeader); port != "6060" {
+			t.Errorf("Expected a stream to port 6060, got %v", port)
+		}
+	}
+}